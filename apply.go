@@ -0,0 +1,473 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+
+// Patches are read in the unified diff format written by 'lvc diff', see
+// printFileDiff. Paths have their first component stripped like patch -p1,
+// and anything outside of the file patches, like a mail header, is ignored.
+// Patches with binary files are rejected as a whole, see printBinaryFileDiff.
+//
+// A hunk is first tried at the line given in its header, then at the closest
+// line it matches at. If it does not match anywhere, up to maxFuzz context
+// lines are ignored at the start and end of the hunk.
+
+const maxFuzz = 2
+
+
+type patchHunk struct {
+    header   string
+    oldStart int
+    oldCount int
+    newStart int
+    newCount int
+    // Lines prefixed with ' ', '-' or '+', each keeps its newline
+    // unless it was followed by "\ No newline at end of file"
+    lines    []string
+}
+
+
+// A patch for a single file, the old path is empty for new files and
+// the new path is empty for deleted files
+type filePatch struct {
+    oldPath string
+    newPath string
+    hunks   []patchHunk
+}
+
+
+// The outcome of applying a file patch, nothing is written until every
+// file patch has been applied in memory
+type patchResult struct {
+    patch    filePatch
+    text     string
+    rejected []patchHunk
+}
+
+
+func patchName(p filePatch) string {
+    if p.newPath == "" {
+        return p.oldPath
+    }
+    return p.newPath
+}
+
+
+// Returns the path of a ---/+++ line, or an empty path for /dev/null. Paths
+// that are absolute, contain a ".." component or are inside .lvc are rejected,
+// so a patch can never write outside of the working tree.
+func parsePatchPath(line string, prefix string) (string, error) {
+    path := strings.TrimPrefix(line, prefix)
+    // Some tools add a timestamp after a tab
+    if tab := strings.Index(path, "\t"); tab != -1 {
+        path = path[:tab]
+    }
+    path = strings.TrimSpace(path)
+
+    if path == "/dev/null" {
+        return "", nil
+    }
+    if strings.HasPrefix(path, "/") || filepath.IsAbs(path) {
+        return "", errors.New("absolute path '" + path + "'")
+    }
+    if slash := strings.Index(path, "/"); slash != -1 {
+        path = path[slash+1:]
+    }
+
+    if path == "" || filepath.IsAbs(path) {
+        return "", errors.New("invalid path '" + path + "'")
+    }
+    for _, part := range strings.Split(filepath.ToSlash(path), "/") {
+        if part == ".." {
+            return "", errors.New("path '" + path + "' is outside of the repository")
+        }
+    }
+    if isLvcDirPath(path) {
+        return "", errors.New("path '" + path + "' is inside .lvc")
+    }
+    return path, nil
+}
+
+
+// Returns true if the repository relative path is .lvc or inside it. The
+// comparison ignores case, since most filesystems on Windows and macOS do.
+func isLvcDirPath(path string) bool {
+    first := strings.SplitN(filepath.ToSlash(filepath.Clean(path)), "/", 2)[0]
+    return strings.EqualFold(first, ".lvc")
+}
+
+
+// Returns the absolute path of a patch path, exits if it is outside of the
+// working tree
+func patchTargetPath(root string, path string) string {
+    target := filepath.Join(root, filepath.FromSlash(path))
+    if !pathIsInside(root, target) {
+        fmt.Fprintln(os.Stderr, "error: '" + path + "' is outside of the repository")
+        os.Exit(1)
+    }
+    if rel, err := filepath.Rel(root, target); err != nil || isLvcDirPath(rel) {
+        fmt.Fprintln(os.Stderr, "error: '" + path + "' is inside .lvc")
+        os.Exit(1)
+    }
+    return target
+}
+
+
+func parsePatch(text string) ([]filePatch, error) {
+    lines := splitLines(text)
+    patches := make([]filePatch, 0)
+
+    for i := 0; i < len(lines); i++ {
+        // Binary diffs only say that the files differ, applying the rest of
+        // the patch would leave out the binary file without anyone noticing
+        if strings.HasPrefix(lines[i], "Binary files ") && strings.Contains(lines[i], " differ") {
+            return nil, fmt.Errorf("line %d: binary patches are not supported", i+1)
+        }
+        if !strings.HasPrefix(lines[i], "--- ") || i+1 >= len(lines) || !strings.HasPrefix(lines[i+1], "+++ ") {
+            continue
+        }
+
+        oldPath, err := parsePatchPath(lines[i], "--- ")
+        if err != nil {
+            return nil, fmt.Errorf("line %d: %s", i+1, err.Error())
+        }
+        newPath, err := parsePatchPath(lines[i+1], "+++ ")
+        if err != nil {
+            return nil, fmt.Errorf("line %d: %s", i+2, err.Error())
+        }
+
+        patch := filePatch{
+            oldPath: oldPath,
+            newPath: newPath,
+            hunks: make([]patchHunk, 0),
+        }
+        if patch.oldPath == "" && patch.newPath == "" {
+            return nil, fmt.Errorf("line %d: both files are /dev/null", i+1)
+        }
+        i += 2
+
+        for i < len(lines) && strings.HasPrefix(lines[i], "@@ ") {
+            h := patchHunk{
+                header: strings.TrimRight(lines[i], "\r\n"),
+            }
+            if err := parseHunkHeader(h.header, &h); err != nil {
+                return nil, fmt.Errorf("line %d: %s", i+1, err.Error())
+            }
+            i++
+
+            oldLeft, newLeft := h.oldCount, h.newCount
+            for (oldLeft > 0 || newLeft > 0) && i < len(lines) {
+                line := lines[i]
+                // Editors and mail clients like to strip the space of empty context lines
+                if line == "\n" {
+                    line = " \n"
+                }
+
+                switch line[0] {
+                case ' ':
+                    oldLeft--
+                    newLeft--
+                case '-':
+                    oldLeft--
+                case '+':
+                    newLeft--
+                case '\\':
+                    i++
+                    continue
+                default:
+                    return nil, fmt.Errorf("line %d: unexpected line in hunk", i+1)
+                }
+                h.lines = append(h.lines, line)
+                i++
+
+                if i < len(lines) && strings.HasPrefix(lines[i], "\\") {
+                    last := len(h.lines) - 1
+                    h.lines[last] = strings.TrimSuffix(h.lines[last], "\n")
+                    i++
+                }
+            }
+            if oldLeft != 0 || newLeft != 0 {
+                return nil, fmt.Errorf("hunk '%s' is truncated", h.header)
+            }
+
+            patch.hunks = append(patch.hunks, h)
+        }
+        i--
+
+        patches = append(patches, patch)
+    }
+
+    if len(patches) == 0 {
+        return nil, errors.New("no file patches found")
+    }
+    return patches, nil
+}
+
+
+// Parses "@@ -<start>[,<count>] +<start>[,<count>] @@"
+func parseHunkHeader(header string, h *patchHunk) error {
+    fields := strings.Fields(header)
+    if len(fields) < 4 || fields[3] != "@@" || !strings.HasPrefix(fields[1], "-") || !strings.HasPrefix(fields[2], "+") {
+        return errors.New("invalid hunk header '" + header + "'")
+    }
+
+    parseRange := func(text string, start *int, count *int) error {
+        *count = 1
+        if comma := strings.Index(text, ","); comma != -1 {
+            if _, err := fmt.Sscanf(text[comma+1:], "%d", count); err != nil {
+                return errors.New("invalid hunk header '" + header + "'")
+            }
+            text = text[:comma]
+        }
+        if _, err := fmt.Sscanf(text, "%d", start); err != nil {
+            return errors.New("invalid hunk header '" + header + "'")
+        }
+        return nil
+    }
+
+    if err := parseRange(fields[1][1:], &h.oldStart, &h.oldCount); err != nil {
+        return err
+    }
+    return parseRange(fields[2][1:], &h.newStart, &h.newCount)
+}
+
+
+// Returns the lines the hunk expects, and the lines it replaces them with
+func hunkSides(lines []string) ([]string, []string) {
+    expected := make([]string, 0)
+    replacement := make([]string, 0)
+    for _, line := range lines {
+        switch line[0] {
+        case ' ':
+            expected = append(expected, line[1:])
+            replacement = append(replacement, line[1:])
+        case '-':
+            expected = append(expected, line[1:])
+        case '+':
+            replacement = append(replacement, line[1:])
+        }
+    }
+    return expected, replacement
+}
+
+
+// Drops up to fuzz context lines from the start and end of the hunk,
+// returns the remaining lines and how many were dropped from the start
+func trimContext(lines []string, fuzz int) ([]string, int) {
+    start := 0
+    for start < fuzz && start < len(lines) && lines[start][0] == ' ' {
+        start++
+    }
+    end := len(lines)
+    for len(lines) - end < fuzz && end > start && lines[end-1][0] == ' ' {
+        end--
+    }
+    return lines[start:end], start
+}
+
+
+func linesMatchAt(lines []string, at int, expected []string) bool {
+    if at < 0 || at + len(expected) > len(lines) {
+        return false
+    }
+    for i, e := range expected {
+        if lines[at+i] != e {
+            return false
+        }
+    }
+    return true
+}
+
+
+// Finds where the expected lines match, searching outwards from want and
+// never before earliest. Returns -1 if they do not match anywhere.
+func findHunkPosition(lines []string, expected []string, want int, earliest int) int {
+    for distance := 0; want - distance >= earliest || want + distance <= len(lines); distance++ {
+        if at := want - distance; at >= earliest && linesMatchAt(lines, at, expected) {
+            return at
+        }
+        if at := want + distance; distance > 0 && at >= earliest && linesMatchAt(lines, at, expected) {
+            return at
+        }
+    }
+    return -1
+}
+
+
+// Applies the hunks to text, returns the result and the hunks that did not apply
+func applyHunksToText(name string, text string, hunks []patchHunk) (string, []patchHunk) {
+    lines := splitLines(text)
+    rejected := make([]patchHunk, 0)
+
+    // Lines added minus lines removed by the hunks applied so far
+    offset := 0
+    // Hunks are applied in order and cannot overlap
+    earliest := 0
+
+    for n, h := range hunks {
+        applied := false
+        for fuzz := 0; fuzz <= maxFuzz && !applied; fuzz++ {
+            trimmed, dropped := trimContext(h.lines, fuzz)
+            expected, replacement := hunkSides(trimmed)
+
+            want := h.oldStart - 1 + offset + dropped
+            if h.oldCount == 0 {
+                want = h.oldStart + offset
+            }
+
+            at := findHunkPosition(lines, expected, want, earliest)
+            if at == -1 {
+                continue
+            }
+
+            result := make([]string, 0, len(lines) - len(expected) + len(replacement))
+            result = append(result, lines[:at]...)
+            result = append(result, replacement...)
+            result = append(result, lines[at+len(expected):]...)
+            lines = result
+
+            earliest = at + len(replacement)
+            offset += len(replacement) - len(expected)
+            applied = true
+
+            if at != want || fuzz > 0 {
+                fmt.Printf("Hunk #%d of %s applied at %d (offset %d lines, fuzz %d)\n", n+1, name, at+1, at-want, fuzz)
+            }
+        }
+
+        if !applied {
+            rejected = append(rejected, h)
+        }
+    }
+
+    return strings.Join(lines, ""), rejected
+}
+
+
+// Applies every file patch in memory against the working tree
+func applyFilePatches(patches []filePatch) ([]patchResult, error) {
+    root, _ := findLvcRoot()
+    results := make([]patchResult, 0)
+
+    for _, p := range patches {
+        // Every target is checked before anything is read or written
+        if p.newPath != "" {
+            patchTargetPath(root, p.newPath)
+        }
+
+        text := ""
+        if p.oldPath != "" {
+            data, err := ioutil.ReadFile(patchTargetPath(root, p.oldPath))
+            if err != nil {
+                return nil, fmt.Errorf("'%s' does not exist in the working tree", p.oldPath)
+            }
+            text = string(data)
+        } else if _, err := os.Stat(patchTargetPath(root, p.newPath)); err == nil {
+            return nil, fmt.Errorf("'%s' already exists in the working tree", p.newPath)
+        }
+
+        result, rejected := applyHunksToText(patchName(p), text, p.hunks)
+        if p.newPath == "" && len(rejected) == 0 && result != "" {
+            return nil, fmt.Errorf("'%s' is not empty after applying the patch that deletes it", p.oldPath)
+        }
+
+        results = append(results, patchResult{
+            patch: p,
+            text: result,
+            rejected: rejected,
+        })
+    }
+
+    return results, nil
+}
+
+
+// Writes the patched files to the working tree, and to the stage when
+// stage is set. Rejected hunks are written to <path>.rej.
+func writePatchResults(results []patchResult, stage bool) {
+    root, _ := findLvcRoot()
+    head := getHead()
+    entries := readStage()
+
+    for _, r := range results {
+        oldName := filepath.FromSlash(r.patch.oldPath)
+        // A deleted file is kept if some of its hunks were rejected
+        deleted := r.patch.newPath == "" && len(r.rejected) == 0
+        if r.patch.oldPath != "" && r.patch.oldPath != r.patch.newPath && (deleted || r.patch.newPath != "") {
+            if err := removeFileAndEmptyDirs(root, patchTargetPath(root, r.patch.oldPath)); err != nil {
+                panic(err)
+            }
+            if stage {
+                if _, ok := findCommitFile(head.files, oldName); ok {
+                    entries = setStageEntry(entries, StageEntry{name: oldName, id: zeroID})
+                } else {
+                    entries, _ = removeStageEntry(entries, oldName)
+                }
+            }
+        }
+
+        if r.patch.newPath != "" {
+            path := patchTargetPath(root, r.patch.newPath)
+            if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+                panic(err)
+            }
+            if err := writeFile(path, r.text); err != nil {
+                panic(err)
+            }
+            if stage {
+                entries = setStageEntry(entries, StageEntry{
+                    name: filepath.FromSlash(r.patch.newPath),
+                    id: createBlob([]byte(r.text)),
+                })
+            }
+        }
+
+        name := patchName(r.patch)
+        if len(r.rejected) > 0 {
+            writeRejects(patchTargetPath(root, name + ".rej"), r.patch, r.rejected)
+            fmt.Printf("Applied %s with %d rejected hunk(s), see %s.rej\n", name, len(r.rejected), name)
+        } else {
+            fmt.Println("Applied " + name)
+        }
+    }
+
+    if stage {
+        writeStage(entries)
+    }
+}
+
+
+func writeRejects(path string, patch filePatch, hunks []patchHunk) {
+    oldName := "/dev/null"
+    if patch.oldPath != "" {
+        oldName = "a/" + patch.oldPath
+    }
+    newName := "/dev/null"
+    if patch.newPath != "" {
+        newName = "b/" + patch.newPath
+    }
+
+    builder := strings.Builder{}
+    builder.WriteString("--- " + oldName + "\n")
+    builder.WriteString("+++ " + newName + "\n")
+    for _, h := range hunks {
+        builder.WriteString(h.header + "\n")
+        for _, line := range h.lines {
+            builder.WriteString(line)
+            if !strings.HasSuffix(line, "\n") {
+                builder.WriteString("\n\\ No newline at end of file\n")
+            }
+        }
+    }
+
+    if err := writeFile(path, builder.String()); err != nil {
+        panic(err)
+    }
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+
+func TestParsePatchPath(t *testing.T) {
+    tests := []struct {
+        line    string
+        path    string
+        invalid bool
+    }{
+        {"+++ b/file.txt", "file.txt", false},
+        {"+++ b/dir/file.txt\t2020-01-01 00:00:00", "dir/file.txt", false},
+        {"+++ /dev/null", "", false},
+        {"+++ b/.lvcignore", ".lvcignore", false},
+        {"+++ b/../escaped.txt", "", true},
+        {"+++ b/dir/../../escaped.txt", "", true},
+        {"+++ /tmp/escaped.txt", "", true},
+        {"+++ b/.lvc/trusted_keys", "", true},
+        {"+++ b/.lvc/head", "", true},
+        {"+++ b/.LVC/head", "", true},
+        {"+++ b/./.lvc/head", "", true},
+        {"+++ b/dir/../.lvc/head", "", true},
+    }
+
+    for _, test := range tests {
+        path, err := parsePatchPath(test.line, "+++ ")
+        if test.invalid {
+            if err == nil {
+                t.Errorf("parsePatchPath(%q) = %q, expected an error", test.line, path)
+            }
+            continue
+        }
+        if err != nil {
+            t.Errorf("parsePatchPath(%q) failed: %v", test.line, err)
+        } else if path != test.path {
+            t.Errorf("parsePatchPath(%q) = %q, expected %q", test.line, path, test.path)
+        }
+    }
+}
+
+
+func TestParsePatchRefusesLvcDir(t *testing.T) {
+    patches := []string{
+        "--- /dev/null\n+++ b/.lvc/trusted_keys\n@@ -0,0 +1 @@\n+key thebirk\n",
+        "--- a/.lvc/head\n+++ b/.lvc/head\n@@ -1 +1 @@\n-master\n+other\n",
+        // Renames out of .lvc are refused as well
+        "--- a/.lvc/config\n+++ b/config\n@@ -1 +1 @@\n-a\n+b\n",
+    }
+
+    for _, patch := range patches {
+        if _, err := parsePatch(patch); err == nil || !strings.Contains(err.Error(), ".lvc") {
+            t.Errorf("parsePatch accepted a patch for .lvc, err = %v\n%s", err, patch)
+        }
+    }
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+
+// A file is binary when it has a NUL byte in its first binarySniffLength
+// bytes. The attributes file .lvcattributes in the repository root
+// overrides the detection, one pattern per line:
+//  *.png     binary
+//  *.svg     text
+//  docs/*.md text
+//  # comment
+//
+// Patterns without a '/' match the file name in any directory, the last
+// matching pattern wins. Binary files are never diffed or merged line by
+// line: diff shows their sizes and hashes, and a merge where both sides
+// changed a binary file is a conflict that keeps the version of HEAD.
+
+const binarySniffLength = 8000
+
+const attributesFileName = ".lvcattributes"
+
+
+// Returns "binary", "text" or "" if no pattern in the attributes file matches name
+func fileAttribute(name string) string {
+    root, err := findLvcRoot()
+    if err != nil {
+        return ""
+    }
+    f, err := os.Open(filepath.Join(root, attributesFileName))
+    if err != nil {
+        return ""
+    }
+    defer f.Close()
+
+    name = filepath.ToSlash(name)
+    attribute := ""
+    scanner := bufio.NewScanner(f)
+    for scanner.Scan() {
+        fields := strings.Fields(scanner.Text())
+        if len(fields) != 2 || strings.HasPrefix(fields[0], "#") {
+            continue
+        }
+        if fields[1] != "binary" && fields[1] != "text" {
+            continue
+        }
+
+        subject := name
+        if !strings.Contains(fields[0], "/") {
+            subject = filepath.Base(filepath.FromSlash(name))
+        }
+        if ok, _ := filepath.Match(fields[0], subject); ok {
+            attribute = fields[1]
+        }
+    }
+
+    return attribute
+}
+
+
+func isBinary(name string, data []byte) bool {
+    switch fileAttribute(name) {
+    case "binary":
+        return true
+    case "text":
+        return false
+    }
+
+    if len(data) > binarySniffLength {
+        data = data[:binarySniffLength]
+    }
+    return bytes.IndexByte(data, 0) != -1
+}
+
+
+// Describes one side of a binary diff, ex. "1234 bytes 1a2b3c4d5e6f"
+func describeBinarySide(side diffSide, name string, size int) string {
+    f, ok := findCommitFile(side.files, name)
+    if !ok {
+        return "none"
+    }
+    return fmt.Sprintf("%d bytes %s", size, shortID(f.id))
+}
+
+
+// Writes both versions of the conflicted binary files next to them as <path>.ours
+// and <path>.theirs, so they can be compared with an external tool
+func exportBinaryConflicts(ours []CommitFile, theirs []CommitFile, conflicts []string) {
+    root, _ := findLvcRoot()
+    for _, name := range conflicts {
+        o, inOurs := findCommitFile(ours, name)
+        t, inTheirs := findCommitFile(theirs, name)
+        if !inOurs || !inTheirs {
+            continue
+        }
+
+        oursData := readBlob(o.id)
+        theirsData := readBlob(t.id)
+        if !isBinary(name, oursData) && !isBinary(name, theirsData) {
+            continue
+        }
+
+        path := filepath.Join(root, name)
+        if err := writeFile(path + ".ours", string(oursData)); err != nil {
+            panic(err)
+        }
+        if err := writeFile(path + ".theirs", string(theirsData)); err != nil {
+            panic(err)
+        }
+        fmt.Printf("Exported both versions of %s to %s.ours and %s.theirs\n", name, name, name)
+    }
+}
+
+
+// Marks binary files in the lists of status
+func describeStatusFile(name string, data []byte) string {
+    if isBinary(name, data) {
+        return name + " (binary)"
+    }
+    return name
+}
+
+
+// Marks conflicted binary files, their working tree file is the version of HEAD
+func describeConflict(name string) string {
+    root, _ := findLvcRoot()
+    data, err := ioutil.ReadFile(filepath.Join(root, name))
+    if err == nil && isBinary(name, data) {
+        return name + " (binary, the version of HEAD is kept)"
+    }
+    return name
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+
+func TestStatusMarksBinaryFiles(t *testing.T) {
+    root, cleanup := newTestRepo(t)
+    defer cleanup()
+
+    if got := describeStatusFile("notes.txt", []byte("text\n")); got != "notes.txt" {
+        t.Errorf("text file described as %q", got)
+    }
+    if got := describeStatusFile("image.png", []byte("PNG\x00\x01")); got != "image.png (binary)" {
+        t.Errorf("binary file described as %q", got)
+    }
+
+    // The attributes file overrides the detection both ways
+    if err := writeFile(filepath.Join(root, attributesFileName), "*.dat binary\nraw/*.bin text\n"); err != nil {
+        t.Fatal(err)
+    }
+    if got := describeStatusFile("data.dat", []byte("text\n")); got != "data.dat (binary)" {
+        t.Errorf("file marked binary by an attribute described as %q", got)
+    }
+    if got := describeStatusFile("raw/x.bin", []byte("a\x00b")); got != "raw/x.bin" {
+        t.Errorf("file marked text by an attribute described as %q", got)
+    }
+}
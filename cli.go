@@ -2,13 +2,56 @@ package main
 
 import (
 	"bufio"
+	"encoding/base64"
 	"encoding/hex"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"sort"
 	"strings"
+	"time"
+)
+
+
+// The author used for commits and tags when user.author is not set
+const defaultAuthor = "thebirk <totally@fake.mail>"
+
+// Command flags, these are shared between all commands and can be mixed in
+// with the positional arguments, see parseArgs
+var (
+    flagAnnotate      = flag.Bool("a", false, "Create an annotated tag.")
+    flagMessage       = flag.String("m", "", "Message for the commit or annotated tag.")
+    flagDelete        = flag.Bool("d", false, "Delete the given tags.")
+    flagForce         = flag.Bool("force", false, "Move a tag that already exists, or amend a commit others depend on.")
+    flagShowSignature = flag.Bool("show-signature", false, "Verify and show commit signatures in the log.")
+    flagAuthor        = flag.String("author", "", "Author of the commit, overrides LVC_AUTHOR.")
+    flagDate          = flag.String("date", "", "Date the commit was authored, overrides LVC_AUTHOR_DATE.")
+    flagCommitter     = flag.String("committer", "", "Committer of the commit, overrides LVC_COMMITTER.")
+    flagCommitterDate = flag.String("committer-date", "", "Date of the commit, overrides LVC_COMMITTER_DATE.")
+    flagAmend         = flag.Bool("amend", false, "Replace the last commit instead of creating a new one.")
+    flagSoft          = flag.Bool("soft", false, "Reset only the branch, keeping the stage and working tree.")
+    flagMixed         = flag.Bool("mixed", false, "Reset the branch and the stage, keeping the working tree.")
+    flagHard          = flag.Bool("hard", false, "Reset the branch, the stage and the working tree.")
+    flagSource        = flag.String("source", "", "Revision to restore files from.")
+    flagStaged        = flag.Bool("staged", false, "Restore files in the stage instead of the working tree, or diff the stage.")
+    flagContinue      = flag.Bool("continue", false, "Continue the operation after resolving conflicts.")
+    flagAbort         = flag.Bool("abort", false, "Abort the operation in progress.")
+    flagSkip          = flag.Bool("skip", false, "Skip the commit that stopped the rebase.")
+    flagInteractive   = flag.Bool("i", false, "Edit the list of commits to rebase before rebasing.")
+    flagUnified       = flag.Int("U", 3, "Number of context lines to show around changes in diffs, ex. -U5.")
+    flagStage         = flag.Bool("stage", false, "Stage the patched files as well.")
+    flagCheck         = flag.Bool("check", false, "Only check if the patch applies, without changing any files.")
+    flagReject        = flag.Bool("reject", false, "Apply the hunks that apply and write the rest to .rej files.")
+    flagStat          = flag.Bool("stat", false, "Show the changed lines of each file as a histogram in diff and log.")
+    flagNumstat       = flag.Bool("numstat", false, "Show the number of added and deleted lines of each file in diff and log.")
+    flagShortstat     = flag.Bool("shortstat", false, "Show only the total number of changed files and lines in diff and log.")
+    flagNameStatus    = flag.Bool("name-status", false, "Show only the names and status of changed files in diff and log.")
+    flagDiffAlgorithm = flag.String("diff-algorithm", "", "Algorithm used to diff lines: myers, patience or histogram. Overrides diff.algorithm.")
+    flagExportBinary  = flag.Bool("export-binary", false, "Write both versions of conflicted binary files to <path>.ours and <path>.theirs.")
+    flagWordDiff      = wordDiffFlag("word-diff", "Mark the changed words within lines in diffs, ex. --word-diff=color. Modes: plain (default), color.")
 )
 
 
@@ -54,6 +97,48 @@ func printUsage() {
 }
 
 
+// Index in flag.Args() of the first argument after "--", or -1 if there was no "--"
+var dashDashIndex = -1
+
+// Parses the flags even when they are mixed in with the positional arguments,
+// so that both 'tag -a name -m msg' and 'tag name -a -m msg' work.
+// Afterwards flag.Args() only contains the positional arguments.
+func parseArgs(args []string) {
+    positional := make([]string, 0)
+
+    // -U<n> is written without a separator, flag only accepts -U=<n>
+    for i, arg := range args {
+        if arg == "--" {
+            break
+        }
+        if strings.HasPrefix(arg, "-U") && len(arg) > 2 && arg[2] != '=' {
+            args[i] = "-U=" + arg[2:]
+        }
+    }
+
+    for {
+        flag.CommandLine.Parse(args)
+        rest := flag.Args()
+        if len(rest) == 0 {
+            break
+        }
+
+        // flag stops parsing at "--", everything after it is positional
+        consumed := len(args) - len(rest)
+        if consumed > 0 && args[consumed-1] == "--" {
+            dashDashIndex = len(positional)
+            positional = append(positional, rest...)
+            break
+        }
+
+        positional = append(positional, rest[0])
+        args = rest[1:]
+    }
+
+    flag.CommandLine.Parse(append([]string{"--"}, positional...))
+}
+
+
 func assumeLvcRepo() {
     _, err := findLvcRoot()
     if err != nil {
@@ -121,29 +206,195 @@ func commandAdd() {
 
 func commandCommit() {
     assumeLvcRepo()
+    // Amending is how a rebase stopped at an edit step is meant to be used
+    if readSequencerFile("edit") == "" {
+        assumeNoSequencer()
+    }
 
-    if flag.NArg() != 1 {
+    if flag.NArg() > 1 || (flag.NArg() == 1 && *flagMessage != "") {
         printUsage()
-        fmt.Fprintln(os.Stderr, "error: commit only takes the form 'commit \"msg\"")
+        fmt.Fprintln(os.Stderr, "error: commit only takes the form 'commit [\"msg\"]' or 'commit -m \"msg\"'")
+        return
+    }
+
+    var msg string
+    if flag.NArg() == 1 {
+        msg = cleanupMessage(flag.Arg(0), false)
+    } else if *flagMessage != "" {
+        msg = cleanupMessage(*flagMessage, false)
+    } else if !*flagAmend {
+        msg = messageFromEditor(commitMessageTemplate())
+    }
+
+    if *flagAmend {
+        amendHead(msg)
+        return
+    }
+
+    if msg == "" {
+        fmt.Fprintln(os.Stderr, "Aborting commit due to empty commit message.")
         return
     }
 
-    commitStage(flag.Args()[0], "thebirk <totally@fake.mail>")
+    commitStage(newCommitInfo(msg), false)
+}
+
+
+// Replaces HEAD with a commit containing the stage as well, keeping
+// the message unless msg is set and the author unless overridden
+func amendHead(msg string) {
+    head := getHead()
+    if head.parent == zeroID {
+        fmt.Fprintln(os.Stderr, "error: cannot amend the initial commit")
+        os.Exit(1)
+    }
+
+    if !*flagForce {
+        // The old commit lives on in these, so they would no longer match HEAD
+        if children := getChildCommits(head.id); len(children) > 0 {
+            fmt.Fprintf(os.Stderr, "error: %s has %d child commit(s), use --force to amend it anyway\n", hex.EncodeToString(head.id[:]), len(children))
+            os.Exit(1)
+        }
+        if tags := getTagsAt(head.id); len(tags) > 0 {
+            fmt.Fprintf(os.Stderr, "error: %s is tagged as '%s', use --force to amend it anyway\n", hex.EncodeToString(head.id[:]), tags[0].name)
+            os.Exit(1)
+        }
+    }
+
+    info := newCommitInfo(msg)
+    if msg == "" {
+        info.message = head.message
+    }
+    if *flagAuthor == "" && os.Getenv("LVC_AUTHOR") == "" {
+        info.author = head.author
+    }
+    if *flagDate == "" && os.Getenv("LVC_AUTHOR_DATE") == "" {
+        info.timestamp = head.timestamp
+    }
+
+    commitStage(info, true)
 }
 
 
+// Returns a commit with the message, author and committer set for a new commit.
+// The flags take precedence over the environment, which takes precedence over the config.
+func newCommitInfo(msg string) Commit {
+    now := time.Now()
+
+    committer := firstNonEmpty(*flagCommitter, os.Getenv("LVC_COMMITTER"), currentAuthor())
+    committerDate := now
+    if date := firstNonEmpty(*flagCommitterDate, os.Getenv("LVC_COMMITTER_DATE")); date != "" {
+        committerDate = parseDateOrExit(date)
+    }
+
+    author := firstNonEmpty(*flagAuthor, os.Getenv("LVC_AUTHOR"), committer)
+    assumeValidIdentity("committer", committer)
+    assumeValidIdentity("author", author)
+    authorDate := now
+    if date := firstNonEmpty(*flagDate, os.Getenv("LVC_AUTHOR_DATE")); date != "" {
+        authorDate = parseDateOrExit(date)
+    }
+
+    return Commit{
+        message: msg,
+        author: author,
+        timestamp: authorDate,
+        committer: committer,
+        committerTimestamp: committerDate,
+    }
+}
+
+
+func firstNonEmpty(values ...string) string {
+    for _, v := range values {
+        if v != "" {
+            return v
+        }
+    }
+    return ""
+}
+
+
+func parseDateOrExit(text string) time.Time {
+    t, err := parseDate(text)
+    if err != nil {
+        fmt.Fprintln(os.Stderr, "error: " + err.Error())
+        os.Exit(1)
+    }
+    return t
+}
+
+
+func commitMessageTemplate() string {
+    builder := strings.Builder{}
+    builder.WriteString("\n")
+    builder.WriteString("# Please enter the commit message for your changes. Lines starting\n")
+    builder.WriteString("# with '#' will be ignored, and an empty message aborts the commit.\n")
+    builder.WriteString("#\n")
+    builder.WriteString("# On branch " + getBranchFromHead().name + "\n")
+
+    stagedFiles := readStageFile()
+    if len(stagedFiles) > 0 {
+        builder.WriteString("# Staged files:\n")
+        for _, f := range stagedFiles {
+            builder.WriteString("#     " + filepath.ToSlash(f) + "\n")
+        }
+    } else {
+        builder.WriteString("# No staged files\n")
+    }
+
+    return builder.String()
+}
+
+
+// Opens the editor with template and returns the cleaned up message
+func messageFromEditor(template string) string {
+    root, _ := findLvcRoot()
+
+    text, err := editText(filepath.Join(root, ".lvc/message"), template)
+    if err != nil {
+        fmt.Fprintln(os.Stderr, "error: failed to run editor '" + getEditor() + "'")
+        fmt.Fprintln(os.Stderr, err)
+        os.Exit(1)
+    }
+
+    return cleanupMessage(text, true)
+}
+
 
 func commandStatus() {
     assumeLvcRepo()
 
-    fmt.Println("Current branch: " + getBranchFromHead().name)
+    if branch := getBranchFromHead(); branch.name != "" {
+        fmt.Println("Current branch: " + branch.name)
+    } else {
+        fmt.Println("HEAD detached at " + hex.EncodeToString(branch.id[:]))
+    }
     fmt.Println()
 
-    stagedFiles := readStageFile()
-    if len(stagedFiles) > 0 {
+    if operation := getSequencerOperation(); operation != "" {
+        fmt.Printf("A %s is in progress, use 'lvc %s --continue' or 'lvc %s --abort'\n", operation, operation, operation)
+        if edit := readSequencerIDs("edit"); len(edit) > 0 {
+            fmt.Println("Stopped at " + shortID(edit[0]) + " for amending, use 'lvc commit --amend'")
+        }
+        if conflicts := getConflicts(); len(conflicts) > 0 {
+            fmt.Println("Unresolved conflicts:")
+            for _, c := range conflicts {
+                fmt.Println("    " + describeConflict(c))
+            }
+        }
+        fmt.Println()
+    }
+
+    staged := readStage()
+    if len(staged) > 0 {
         fmt.Println("Staged files:")
-        for _, f := range stagedFiles {
-            fmt.Println("    " + f)
+        for _, e := range staged {
+            if e.id == zeroID {
+                fmt.Println("    " + e.name + " (removed)")
+            } else {
+                fmt.Println("    " + describeStatusFile(e.name, readBlob(e.id)))
+            }
         }
     } else {
         fmt.Println("No staged files")
@@ -154,8 +405,10 @@ func commandStatus() {
     modifiedFiles := getModifiedFiles()
     if len(modifiedFiles) > 0 {
         fmt.Println("Unstaged Modified files:")
+        root, _ := findLvcRoot()
         for _, f := range modifiedFiles {
-            fmt.Println("    " + f)
+            data, _ := ioutil.ReadFile(filepath.Join(root, f))
+            fmt.Println("    " + describeStatusFile(f, data))
         }
     }
 }
@@ -169,38 +422,7 @@ func commandLog() {
     var commit Commit
     
     if flag.NArg() >= 1 {
-        // if arg is a valid id, check if that exists
-        // otherwise check if it is a branch
-        arg := flag.Args()[0]
-        if len(arg) == 64 {
-            // This looks like an id
-            stringID, err := hex.DecodeString(arg)
-            if err != nil {
-                fmt.Fprintln(os.Stderr, "error: invalid commit '" + arg + "'")
-                return
-            }
-
-            id := ID{}
-            copy(id[:], stringID)
-
-            commit = getCommitWithoutFiles(id)
-        } else {
-            // cant be an idea, assume branch
-
-            foundBranch := false
-            branches := getAllBranches()
-            for _, b := range branches {
-                if b.name == arg {
-                    commit = getCommitWithoutFiles(b.id)
-                    foundBranch = true
-                }
-            }
-
-            if !foundBranch {
-                fmt.Fprintln(os.Stderr, "error: unknown branch '" + arg + "'")
-                return
-            }
-        }
+        commit = getCommitWithoutFiles(resolveRevisionOrExit(flag.Arg(0)))
     } else {
         commit = getHead()
     }
@@ -213,9 +435,22 @@ func commandLog() {
         }
 
         fmt.Fprintln(in, hex.EncodeToString(commit.id[:]))
-        fmt.Fprintln(in, "date: " + commit.timestamp.Local().String())
+        fmt.Fprintln(in, "date: " + formatDate(commit.timestamp))
         fmt.Fprintln(in, "author: " + commit.author)
-        fmt.Fprintln(in, "message: " + commit.message)
+        if commit.committer != commit.author || !commit.committerTimestamp.Equal(commit.timestamp) {
+            fmt.Fprintln(in, "committer: " + commit.committer)
+            fmt.Fprintln(in, "commit date: " + formatDate(commit.committerTimestamp))
+        }
+        if *flagShowSignature {
+            fmt.Fprintln(in, "signature: " + describeSignature(verifyCommit(commit.id)))
+        }
+        printCommitMessage(in, commit.message)
+        if statModeSelected() {
+            fmt.Fprintln(in)
+            from := diffSide{files: getCommitFiles(commit.parent)}
+            to := diffSide{files: getCommitFiles(commit.id)}
+            printSelectedStats(in, diffStats(from, to), stdoutIsTerminal())
+        }
         fmt.Fprintln(in, )
 
         commit = getCommitWithoutFiles(commit.parent)
@@ -225,6 +460,403 @@ func commandLog() {
 }
 
 
+func printCommitMessage(w io.Writer, msg string) {
+    if !strings.ContainsAny(msg, "\r\n") {
+        fmt.Fprintln(w, "message: " + msg)
+        return
+    }
+
+    fmt.Fprintln(w, "message:")
+    printTextWithPrefixSuffix(w, msg, "    ", "")
+}
+
+
+func commandReset() {
+    assumeLvcRepo()
+
+    modes := 0
+    mode := resetMixed
+    if *flagSoft {
+        mode = resetSoft
+        modes++
+    }
+    if *flagMixed {
+        mode = resetMixed
+        modes++
+    }
+    if *flagHard {
+        mode = resetHard
+        modes++
+    }
+
+    if modes > 1 || (modes == 1 && flag.NArg() > 1) {
+        printUsage()
+        fmt.Fprintln(os.Stderr, "error: usage: reset [--soft|--mixed|--hard] [<rev>] or reset <path>...")
+        return
+    }
+
+    // Without a mode the arguments are paths to unstage, unless it is a single revision
+    if modes == 0 && flag.NArg() > 0 {
+        _, err := resolveRevision(flag.Arg(0))
+        if flag.NArg() > 1 || err != nil || isStagedOrExists(flag.Arg(0)) {
+            for _, f := range flag.Args() {
+                rel := repoRelativePath(f)
+                if !unstageFile(rel) {
+                    fmt.Fprintln(os.Stderr, "error: '" + f + "' is not staged")
+                    continue
+                }
+                fmt.Println("Unstaged " + rel)
+            }
+            return
+        }
+    }
+
+    id := getHeadID()
+    if flag.NArg() == 1 {
+        id = resolveRevisionOrExit(flag.Arg(0))
+    }
+
+    resetHead(id, mode)
+
+    commit := getCommitWithoutFiles(id)
+    fmt.Println("HEAD is now at " + hex.EncodeToString(id[:]) + " " + messageSubject(commit.message))
+}
+
+
+func isStagedOrExists(path string) bool {
+    if _, err := os.Stat(path); err == nil {
+        return true
+    }
+
+    rel := repoRelativePath(path)
+    for _, e := range readStage() {
+        if pathsAreEqual(e.name, rel) {
+            return true
+        }
+    }
+    return false
+}
+
+
+func commandRestore() {
+    assumeLvcRepo()
+
+    if flag.NArg() < 1 {
+        printUsage()
+        fmt.Fprintln(os.Stderr, "error: usage: restore [--source <rev>] [--staged] <path>...")
+        return
+    }
+
+    // The working tree is restored from the stage and the stage from HEAD by default
+    var source []CommitFile
+    sourceName := *flagSource
+    if *flagSource != "" {
+        source = getCommit(resolveRevisionOrExit(*flagSource)).files
+    } else if *flagStaged {
+        source = getHead().files
+        sourceName = "HEAD"
+    } else {
+        source = getStagedFiles()
+        sourceName = "the stage"
+    }
+
+    for _, path := range flag.Args() {
+        rel := repoRelativePath(path)
+
+        var restored []CommitFile
+        if *flagStaged {
+            restored = restoreStagedFiles(source, rel)
+        } else {
+            restored = restoreWorkingFiles(source, rel)
+        }
+
+        if len(restored) == 0 {
+            fmt.Fprintln(os.Stderr, "error: '" + path + "' did not match any files in " + sourceName)
+            continue
+        }
+        for _, f := range restored {
+            fmt.Println("Restored " + f.name)
+        }
+    }
+}
+
+
+func commandRevert() {
+    assumeLvcRepo()
+
+    if *flagAbort || *flagContinue {
+        if getSequencerOperation() != "revert" {
+            fmt.Fprintln(os.Stderr, "error: no revert in progress")
+            os.Exit(1)
+        }
+
+        if *flagAbort {
+            abortSequencer()
+            fmt.Println("Revert aborted")
+            return
+        }
+
+        assumeNoConflicts("revert")
+        commitStage(newCommitInfo(readSequencerFile("message")), false)
+        clearSequencer()
+        return
+    }
+
+    if flag.NArg() != 1 {
+        printUsage()
+        fmt.Fprintln(os.Stderr, "error: usage: revert <rev> or revert --continue|--abort")
+        return
+    }
+
+    assumeNoSequencer()
+    assumeNoLocalChanges()
+
+    id := resolveRevisionOrExit(flag.Arg(0))
+
+    msg := revertMessage(getCommitWithoutFiles(id))
+    if *flagMessage != "" {
+        msg = cleanupMessage(*flagMessage, false)
+    }
+
+    if !revertCommit(id, newCommitInfo(msg)) {
+        printConflicts("revert")
+        os.Exit(1)
+    }
+}
+
+
+func commandCherryPick() {
+    assumeLvcRepo()
+
+    if *flagAbort || *flagContinue {
+        if getSequencerOperation() != "cherry-pick" {
+            fmt.Fprintln(os.Stderr, "error: no cherry-pick in progress")
+            os.Exit(1)
+        }
+
+        if *flagAbort {
+            abortSequencer()
+            fmt.Println("Cherry-pick aborted")
+            return
+        }
+
+        assumeNoConflicts("cherry-pick")
+        if !continueReplay("cherry-pick") {
+            printConflicts("cherry-pick")
+            os.Exit(1)
+        }
+        return
+    }
+
+    if flag.NArg() < 1 {
+        printUsage()
+        fmt.Fprintln(os.Stderr, "error: usage: cherry-pick <rev>... or cherry-pick --continue|--abort")
+        return
+    }
+
+    assumeNoSequencer()
+    assumeNoLocalChanges()
+
+    ids := make([]ID, 0)
+    for _, rev := range flag.Args() {
+        ids = append(ids, resolveRevisionOrExit(rev))
+    }
+
+    if !replayCommits("cherry-pick", pickAll(ids), getHeadID()) {
+        printConflicts("cherry-pick")
+        os.Exit(1)
+    }
+}
+
+
+func commandRebase() {
+    assumeLvcRepo()
+
+    if *flagAbort || *flagContinue || *flagSkip {
+        if getSequencerOperation() != "rebase" {
+            fmt.Fprintln(os.Stderr, "error: no rebase in progress")
+            os.Exit(1)
+        }
+
+        if *flagAbort {
+            abortSequencer()
+            fmt.Println("Rebase aborted")
+            return
+        }
+
+        ok := false
+        if *flagSkip {
+            ok = skipReplay("rebase")
+        } else {
+            assumeNoConflicts("rebase")
+            ok = continueReplay("rebase")
+        }
+        // Stopping at an edit step is not an error
+        if !ok && len(getConflicts()) > 0 {
+            printConflicts("rebase")
+            os.Exit(1)
+        }
+        return
+    }
+
+    if flag.NArg() != 1 {
+        printUsage()
+        fmt.Fprintln(os.Stderr, "error: usage: rebase [-i] <upstream> or rebase --continue|--skip|--abort")
+        return
+    }
+
+    assumeNoSequencer()
+    assumeNoLocalChanges()
+
+    ok, err := rebaseOnto(resolveRevisionOrExit(flag.Arg(0)), *flagInteractive)
+    if err != nil {
+        fmt.Fprintln(os.Stderr, "error: " + err.Error())
+        os.Exit(1)
+    }
+    if !ok && len(getConflicts()) > 0 {
+        printConflicts("rebase")
+        os.Exit(1)
+    }
+}
+
+
+func commandStash() {
+    assumeLvcRepo()
+
+    subcommand := "push"
+    if flag.NArg() > 0 {
+        subcommand = flag.Arg(0)
+    }
+
+    ref := "0"
+    if flag.NArg() > 2 || (flag.NArg() == 2 && subcommand == "push") || (flag.NArg() == 2 && subcommand == "list") {
+        printUsage()
+        fmt.Fprintln(os.Stderr, "error: usage: stash [push [-m msg]|pop|apply|list|drop|show] [stash@{n}]")
+        return
+    } else if flag.NArg() == 2 {
+        ref = flag.Arg(1)
+    }
+
+    switch subcommand {
+    case "push":
+        assumeNoSequencer()
+        if !stashPush(*flagMessage) {
+            fmt.Println("No local changes to save")
+        }
+    case "list":
+        stashList()
+    case "show":
+        stashShow(assumeStashEntry(ref))
+    case "drop":
+        stashDrop(assumeStashEntry(ref))
+    case "apply", "pop":
+        assumeNoSequencer()
+        assumeNoLocalChanges()
+        index := assumeStashEntry(ref)
+        if !stashApply(index) {
+            os.Exit(1)
+        }
+        if subcommand == "pop" {
+            stashDrop(index)
+        }
+    default:
+        printUsage()
+        fmt.Fprintln(os.Stderr, "error: unknown stash command '" + subcommand + "'")
+    }
+}
+
+
+func commandReflog() {
+    assumeLvcRepo()
+
+    if flag.NArg() > 1 {
+        printUsage()
+        fmt.Fprintln(os.Stderr, "error: usage: reflog [ref]")
+        return
+    }
+
+    ref := "HEAD"
+    if flag.NArg() == 1 {
+        ref = flag.Arg(0)
+    }
+
+    // Branches take precedence over tags with the same name
+    var entries []ReflogEntry
+    if ref == "HEAD" || (validateRefName(ref) == nil && refExists(branchPath(ref))) {
+        entries = readReflog(ref)
+    } else if validateRefName(ref) == nil && refExists(tagPath(ref)) {
+        entries = readTagReflog(ref)
+    } else {
+        fmt.Fprintln(os.Stderr, "error: unknown branch or tag '" + ref + "'")
+        os.Exit(1)
+    }
+
+    cmd, in := startPager()
+    for i, e := range entries {
+        fmt.Fprintf(in, "%s %s@{%d}: %s\n", shortID(e.new), ref, i, e.reason)
+        fmt.Fprintf(in, "    %s by %s\n", formatDate(e.timestamp), e.identity)
+    }
+    endPager(cmd, in)
+}
+
+
+func commandUndo() {
+    assumeLvcRepo()
+    assumeNoSequencer()
+
+    if len(getModifiedFiles()) > 0 {
+        fmt.Fprintln(os.Stderr, "error: you have unstaged changes, stage or restore them first")
+        os.Exit(1)
+    }
+
+    op, ok := undoOperation()
+    if !ok {
+        fmt.Println("Nothing to undo")
+        return
+    }
+    fmt.Println("Undid 'lvc " + op.command + "' from " + formatDate(op.timestamp))
+}
+
+
+func commandOp() {
+    assumeLvcRepo()
+
+    if flag.NArg() != 1 || flag.Arg(0) != "log" {
+        printUsage()
+        fmt.Fprintln(os.Stderr, "error: usage: op log")
+        return
+    }
+
+    cmd, in := startPager()
+    numbers := listOperations()
+    for i := len(numbers) - 1; i >= 0; i-- {
+        op := readOperation(numbers[i])
+        fmt.Fprintf(in, "%d %s by %s\n", op.number, formatDate(op.timestamp), op.identity)
+        fmt.Fprintf(in, "    lvc %s\n", op.command)
+        fmt.Fprintf(in, "    head was %s\n", op.head)
+    }
+    endPager(cmd, in)
+}
+
+
+func printConflicts(operation string) {
+    fmt.Println("Conflicts in:")
+    for _, c := range getConflicts() {
+        fmt.Println("    " + describeConflict(c))
+    }
+    fmt.Printf("Resolve the conflicts, stage them with 'lvc add' and run 'lvc %s --continue', or run 'lvc %s --abort'\n", operation, operation)
+}
+
+
+func assumeNoConflicts(operation string) {
+    if len(getConflicts()) > 0 {
+        fmt.Fprintln(os.Stderr, "error: there are unresolved conflicts")
+        printConflicts(operation)
+        os.Exit(1)
+    }
+}
+
+
 func commandBranch() {
     assumeLvcRepo()
     if flag.NArg() == 0 {
@@ -249,15 +881,63 @@ func commandBranch() {
 func commandTag() {
     assumeLvcRepo()
 
-    if flag.NArg() != 1 {
+    if *flagDelete {
+        if flag.NArg() < 1 {
+            printUsage()
+            fmt.Fprintln(os.Stderr, "error: usage: tag -d <tag-name>...")
+            return
+        }
+
+        for _, name := range flag.Args() {
+            id := getTagID(name)
+            deleteTag(name, "tag: deleted")
+            fmt.Printf("Deleted tag '%s' (was %s)\n", name, hex.EncodeToString(id[:]))
+        }
+        return
+    }
+
+    if flag.NArg() < 1 || flag.NArg() > 2 {
         printUsage()
-        fmt.Fprintln(os.Stderr, "error: usage: tag <tag-name>")
+        fmt.Fprintln(os.Stderr, "error: usage: tag [-a] [-m <msg>] [--force] <tag-name> [<rev>]")
         return
     }
 
     tagName := flag.Arg(0)
+    assumeValidRefName("tag", tagName)
+
+    if *flagAnnotate && *flagMessage == "" {
+        fmt.Fprintln(os.Stderr, "error: annotated tags require a message, use -m <msg>")
+        os.Exit(1)
+    }
 
-    createTagAtHead(tagName)
+    target := getHeadID()
+    if flag.NArg() == 2 {
+        target = resolveRevisionOrExit(flag.Arg(1))
+    }
+
+    // A message makes the tag annotated even without -a
+    var annotation *TagObject
+    if *flagMessage != "" {
+        assumeValidIdentity("tagger", currentAuthor())
+        annotation = &TagObject{
+            tagger: currentAuthor(),
+            timestamp: time.Now(),
+            message: *flagMessage,
+        }
+    }
+
+    // The existing tag is overwritten by createTag, so it is never lost on an error
+    force := false
+    if *flagForce && refExists(tagPath(tagName)) {
+        current := getTagID(tagName)
+        if !yesno(fmt.Sprintf("Tag '%s' points to %s, are you sure you want to move it to %s?", tagName, hex.EncodeToString(current[:]), hex.EncodeToString(target[:])), false) {
+            fmt.Println("Stopping tag due to user input.")
+            return
+        }
+        force = true
+    }
+
+    createTag(tagName, target, annotation, force)
 }
 
 
@@ -273,7 +953,77 @@ func commandTags() {
     tags := getAllTags()
     for _, t := range tags {
         fmt.Println(t.name, hex.EncodeToString(t.id[:]))
+
+        if t.annotation != zeroID {
+            annotation := getTagObject(t.annotation)
+            fmt.Println("    tagger: " + annotation.tagger)
+            fmt.Println("    date: " + formatDate(annotation.timestamp))
+            fmt.Println()
+            printTextWithPrefixSuffix(os.Stdout, annotation.message, "        ", "")
+            fmt.Println()
+        }
+    }
+}
+
+
+func commandVerify() {
+    assumeLvcRepo()
+
+    if flag.NArg() != 1 {
+        printUsage()
+        fmt.Fprintln(os.Stderr, "error: usage: verify <rev>")
+        return
+    }
+
+    rev := flag.Arg(0)
+
+    // Annotated tags carry their own signature
+    var status signatureStatus
+    var signer string
+    if validateRefName(rev) == nil && !refExists(branchPath(rev)) && refExists(tagPath(rev)) && getTag(rev).annotation != zeroID {
+        status, signer = verifyTagObject(getTag(rev).annotation)
+        fmt.Println("tag " + rev + ": " + describeSignature(status, signer))
+    } else {
+        id := resolveRevisionOrExit(rev)
+        status, signer = verifyCommit(id)
+        fmt.Println("commit " + hex.EncodeToString(id[:]) + ": " + describeSignature(status, signer))
+    }
+
+    if status != sigGood {
+        os.Exit(1)
+    }
+}
+
+
+func commandKeygen() {
+    if flag.NArg() < 1 || flag.NArg() > 2 {
+        printUsage()
+        fmt.Fprintln(os.Stderr, "error: usage: keygen <path> [<identity>]")
+        return
     }
+
+    path := flag.Arg(0)
+    // Signatures are only good for commits whose committer matches the identity
+    identity := currentAuthor()
+    if flag.NArg() == 2 {
+        identity = flag.Arg(1)
+    }
+
+    public, err := generateSigningKey(path, identity)
+    if err != nil {
+        fmt.Fprintln(os.Stderr, "error: failed to generate key")
+        fmt.Fprintln(os.Stderr, err)
+        os.Exit(1)
+    }
+
+    abs, _ := filepath.Abs(path)
+    fmt.Println("Created signing key " + abs)
+    fmt.Println("Public key: " + base64.StdEncoding.EncodeToString(public))
+    fmt.Println("Identity: " + identity)
+    fmt.Println()
+    fmt.Println("Sign commits and tags by adding this to your config:")
+    fmt.Println("    user.signingkey = " + abs)
+    fmt.Println("Others can trust the key by adding the contents of '" + path + ".pub' to .lvc/trusted_keys")
 }
 
 
@@ -294,13 +1044,189 @@ func commandCheckout() {
 func commandDiff() {
     assumeLvcRepo()
 
-    if flag.NArg() != 0 {
+    revs := flag.Args()
+    paths := make([]string, 0)
+    if dashDashIndex != -1 {
+        revs = flag.Args()[:dashDashIndex]
+        paths = flag.Args()[dashDashIndex:]
+    }
+    if len(revs) == 1 && strings.Contains(revs[0], "..") {
+        revs = splitRevisionRange(revs[0])
+    }
+
+    if len(revs) > 2 || (*flagStaged && len(revs) > 1) {
+        printUsage()
+        fmt.Fprintln(os.Stderr, "error: usage: diff [--staged] [--word-diff[=color|plain]] [<rev>] [-- <path>...], diff <rev> <rev> [-- <path>...] or diff <rev>..<rev> [-- <path>...]")
+        return
+    }
+
+    // Without revisions the working tree is compared with the stage, and the
+    // stage with HEAD when --staged. A revision replaces the stage or HEAD.
+    from := diffSide{files: getStagedFiles()}
+    to := diffSide{files: getWorkingFiles(), working: true}
+    if *flagStaged {
+        from = diffSide{files: getHead().files}
+        to = diffSide{files: getStagedFiles()}
+    }
+    if len(revs) >= 1 {
+        from = diffSide{files: getCommit(resolveRevisionOrExit(revs[0])).files}
+    }
+    if len(revs) == 2 {
+        to = diffSide{files: getCommit(resolveRevisionOrExit(revs[1])).files}
+    }
+
+    from.files = filterDiffFiles(from.files, paths)
+    to.files = filterDiffFiles(to.files, paths)
+
+    // An unknown algorithm is reported before the pager starts
+    selectedDiffAlgorithm()
+
+    cmd, in := startPager()
+    if statModeSelected() {
+        printSelectedStats(in, diffStats(from, to), stdoutIsTerminal())
+    } else {
+        diffTrees(in, from, to, stdoutIsTerminal())
+    }
+    endPager(cmd, in)
+}
+
+
+func commandApply() {
+    assumeLvcRepo()
+
+    if flag.NArg() != 1 {
+        printUsage()
+        fmt.Fprintln(os.Stderr, "error: usage: apply [--stage] [--check] [--reject] <patchfile>")
+        return
+    }
+
+    data, err := ioutil.ReadFile(flag.Arg(0))
+    if err != nil {
+        fmt.Fprintln(os.Stderr, "error: failed to read '" + flag.Arg(0) + "'")
+        fmt.Fprintln(os.Stderr, err)
+        os.Exit(1)
+    }
+
+    patches, err := parsePatch(string(data))
+    if err != nil {
+        fmt.Fprintln(os.Stderr, "error: invalid patch: " + err.Error())
+        os.Exit(1)
+    }
+
+    results, err := applyFilePatches(patches)
+    if err != nil {
+        fmt.Fprintln(os.Stderr, "error: " + err.Error())
+        os.Exit(1)
+    }
+
+    rejected := 0
+    for _, r := range results {
+        rejected += len(r.rejected)
+        for _, h := range r.rejected {
+            fmt.Fprintf(os.Stderr, "Hunk %s of %s does not apply\n", h.header, patchName(r.patch))
+        }
+    }
+
+    if *flagCheck {
+        if rejected > 0 {
+            os.Exit(1)
+        }
+        fmt.Println("The patch applies cleanly")
+        return
+    }
+
+    // Without --reject nothing is written unless every hunk applies
+    if rejected > 0 && !*flagReject {
+        fmt.Fprintln(os.Stderr, "error: the patch does not apply, no files were changed")
+        os.Exit(1)
+    }
+
+    writePatchResults(results, *flagStage)
+    if rejected > 0 {
+        os.Exit(1)
+    }
+}
+
+
+// Splits "<rev>..<rev>" into its two revisions, an empty side is HEAD,
+// ex. 'master..'. A single revision is returned as is.
+func splitRevisionRange(text string) []string {
+    revs := strings.SplitN(text, "..", 2)
+    if len(revs) == 1 {
+        return revs
+    }
+    for i := range revs {
+        if revs[i] == "" {
+            revs[i] = "HEAD"
+        }
+    }
+    return revs
+}
+
+
+func commandFormatPatch() {
+    assumeLvcRepo()
+
+    if flag.NArg() != 1 {
         printUsage()
-        fmt.Fprintln(os.Stderr, "error: usage: diff")
+        fmt.Fprintln(os.Stderr, "error: usage: format-patch <since> or format-patch <rev>..<rev>")
         return
     }
 
-    diffWorkingWith(getHeadID())
+    // A single revision means everything after it up to HEAD
+    revs := splitRevisionRange(flag.Arg(0))
+    if len(revs) == 1 {
+        revs = append(revs, "HEAD")
+    }
+    since := resolveRevisionOrExit(revs[0])
+    tip := resolveRevisionOrExit(revs[1])
+    base, _ := findMergeBase(tip, since)
+
+    ids := commitsBetween(base, tip)
+    for i, id := range ids {
+        commit := getCommitWithoutFiles(id)
+        name := mailPatchFileName(i+1, messageSubject(commit.message))
+        if err := writeFile(name, encodeMailPatch(commit, i+1, len(ids))); err != nil {
+            fmt.Fprintln(os.Stderr, "error: failed to write '" + name + "'")
+            fmt.Fprintln(os.Stderr, err)
+            os.Exit(1)
+        }
+        fmt.Println(name)
+    }
+}
+
+
+func commandAm() {
+    assumeLvcRepo()
+
+    if flag.NArg() < 1 {
+        printUsage()
+        fmt.Fprintln(os.Stderr, "error: usage: am <patchfile>...")
+        return
+    }
+
+    assumeNoSequencer()
+    assumeNoLocalChanges()
+
+    for _, path := range flag.Args() {
+        data, err := ioutil.ReadFile(path)
+        if err != nil {
+            fmt.Fprintln(os.Stderr, "error: failed to read '" + path + "'")
+            fmt.Fprintln(os.Stderr, err)
+            os.Exit(1)
+        }
+
+        patch, err := parseMailPatch(string(data))
+        if err == nil {
+            fmt.Println("Applying: " + messageSubject(patch.message))
+            err = commitMailPatch(patch)
+        }
+        if err != nil {
+            fmt.Fprintln(os.Stderr, "error: " + path + ": " + err.Error())
+            fmt.Fprintln(os.Stderr, "The patches before it have been committed, nothing was changed by this one")
+            os.Exit(1)
+        }
+    }
 }
 
 
@@ -331,7 +1257,7 @@ func commandGraph() {
         f.WriteString(fmt.Sprintf(
             "commit_%s [label=\"%s\"]\n",
             hex.EncodeToString(id[:]),
-            commit.message,
+            messageSubject(commit.message),
         ))
 
         parentsParent := getCommit(commit.parent)
@@ -349,33 +1275,32 @@ func commandGraph() {
         return nil
     })
 
-    filepath.Walk(root + "/.lvc/branches/", func(path string, info os.FileInfo, err error) error {
-        if info.IsDir() {
-            return nil
-        }
-
-        id := getBranchID(info.Name())
-        
+    for _, b := range getAllBranches() {
         f.WriteString(fmt.Sprintf(
             "\"%s\" [shape=box]\n",
-            info.Name(),
+            b.name,
         ))
 
         f.WriteString(fmt.Sprintf(
             "{rank=same; \"%s\" -> commit_%s}\n",
-            info.Name(),
-            hex.EncodeToString(id[:]),
+            b.name,
+            hex.EncodeToString(b.id[:]),
         ))
-
-        return nil
-    })
+    }
 
     head := getBranchFromHead()
     f.WriteString("HEAD [shape=box, color=red]\n")
-    f.WriteString(fmt.Sprintf(
-        "HEAD -> \"%s\"\n",
-        head.name,
-    ))
+    if head.name != "" {
+        f.WriteString(fmt.Sprintf(
+            "HEAD -> \"%s\"\n",
+            head.name,
+        ))
+    } else {
+        f.WriteString(fmt.Sprintf(
+            "HEAD -> commit_%s\n",
+            hex.EncodeToString(head.id[:]),
+        ))
+    }
 
 
     f.WriteString("}\n")
@@ -394,11 +1319,12 @@ func commandInfo() {
     head := getHead()
 
     firstCommit := getFirstCommit(head.id)
-    fmt.Fprintln(in, "First commit date: " + firstCommit.timestamp.Local().String())
+    fmt.Fprintln(in, "First commit date: " + formatDate(firstCommit.timestamp))
 
-    fmt.Fprintln(in, "Last  commit date: " + head.timestamp.Local().String())
+    fmt.Fprintln(in, "Last  commit date: " + formatDate(head.timestamp))
 
-    fmt.Fprintf(in, "Most recent commit message:\n    %s\n", head.message)
+    fmt.Fprintln(in, "Most recent commit message:")
+    printTextWithPrefixSuffix(in, head.message, "    ", "")
     fmt.Fprintln(in)
 
     fmt.Fprintf(in, "Number of currently tracked files: %d\n", len(head.files))
@@ -476,7 +1402,7 @@ func main() {
     userRoot := ""
     flag.StringVar(&userRoot, "root", "", "Operate on a directory outside of the current repository.")
 
-    flag.CommandLine.Parse(os.Args[2:])
+    parseArgs(os.Args[2:])
 
     if userRoot != "" {
         //TODO: Check if actually root
@@ -493,6 +1419,10 @@ func main() {
     // - list : list all currently tracked files
     // - info : some info and stats about the repo, number of files, root dir, creation date ,last commit date, total commits in active branch, active branch
 
+    if _, err := findLvcRoot(); err == nil && isOperation(os.Args[1]) {
+        recordOperation(strings.Join(os.Args[1:], " "))
+    }
+
     switch os.Args[1] {
     case "init":
         commandInit()
@@ -506,6 +1436,30 @@ func main() {
         panic("//TODO remove")
     case "log":
         commandLog()
+    case "reset":
+        commandReset()
+    case "restore":
+        commandRestore()
+    case "revert":
+        commandRevert()
+    case "cherry-pick":
+        commandCherryPick()
+    case "rebase":
+        commandRebase()
+    case "stash":
+        commandStash()
+    case "reflog":
+        commandReflog()
+    case "apply":
+        commandApply()
+    case "format-patch":
+        commandFormatPatch()
+    case "am":
+        commandAm()
+    case "undo":
+        commandUndo()
+    case "op":
+        commandOp()
     case "ls":
         commandLs()
     case "branch":
@@ -514,6 +1468,10 @@ func main() {
         commandTag()
     case "tags":
         commandTags()
+    case "verify":
+        commandVerify()
+    case "keygen":
+        commandKeygen()
     case "checkout":
         commandCheckout()
     case "diff":
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+
+func TestSplitRevisionRange(t *testing.T) {
+    tests := []struct {
+        text string
+        revs []string
+    }{
+        {"master", []string{"master"}},
+        {"a..b", []string{"a", "b"}},
+        {"HEAD~2..", []string{"HEAD~2", "HEAD"}},
+        {"..feature", []string{"HEAD", "feature"}},
+    }
+
+    for _, test := range tests {
+        if revs := splitRevisionRange(test.text); !reflect.DeepEqual(revs, test.revs) {
+            t.Errorf("splitRevisionRange(%q) = %q, expected %q", test.text, revs, test.revs)
+        }
+    }
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+
+// config format, one option per line:
+//  key = value
+//  # comment
+//
+// The user config lives in ~/.config/lvc/config, or $LVC_HOME/config if LVC_HOME is set.
+// Options in the repository config .lvc/config override the user config.
+//
+// options:
+//  user.author     ; author used for commits and tags, ex. "thebirk <pingnor@gmail.com>"
+//  user.signingkey ; path to an ed25519 key created with 'lvc keygen', commits and annotated tags are signed when set
+//  diff.algorithm  ; myers (default), patience or histogram, used by diff and merges, see diffalgo.go
+
+
+var _config map[string]string
+
+func getConfig(key string) string {
+    if _config == nil {
+        _config = make(map[string]string)
+
+        if path := userConfigPath(); path != "" {
+            readConfigFile(path, _config)
+        }
+        if root, err := findLvcRoot(); err == nil {
+            readConfigFile(filepath.Join(root, ".lvc/config"), _config)
+        }
+    }
+
+    return _config[key]
+}
+
+
+func userConfigPath() string {
+    if lvcHome := os.Getenv("LVC_HOME"); lvcHome != "" {
+        return filepath.Join(lvcHome, "config")
+    }
+
+    home, err := os.UserHomeDir()
+    if err != nil {
+        return ""
+    }
+    return filepath.Join(home, ".config/lvc/config")
+}
+
+
+// Reads all options in path into config, a missing file is not an error
+func readConfigFile(path string, config map[string]string) {
+    f, err := os.Open(path)
+    if err != nil {
+        return
+    }
+    defer f.Close()
+
+    scanner := bufio.NewScanner(f)
+    for scanner.Scan() {
+        line := strings.TrimSpace(scanner.Text())
+        if line == "" || strings.HasPrefix(line, "#") {
+            continue
+        }
+
+        kv := strings.SplitN(line, "=", 2)
+        if len(kv) != 2 {
+            continue
+        }
+        config[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+    }
+}
+
+
+// Expands a leading '~' to the users home directory
+func expandHome(path string) string {
+    if path != "~" && !strings.HasPrefix(path, "~/") {
+        return path
+    }
+
+    home, err := os.UserHomeDir()
+    if err != nil {
+        return path
+    }
+    return filepath.Join(home, path[1:])
+}
+
+
+// Identities are written as a single line of commits and tag objects,
+// a line break would let them add headers or file lines to the object
+func validateIdentity(identity string) error {
+    if strings.ContainsAny(identity, "\r\n") {
+        return errors.New("cannot contain line breaks")
+    }
+    return nil
+}
+
+
+func assumeValidIdentity(kind string, identity string) {
+    if err := validateIdentity(identity); err != nil {
+        fmt.Fprintf(os.Stderr, "error: invalid %s %q: %s\n", kind, identity, err.Error())
+        os.Exit(1)
+    }
+}
+
+
+func currentAuthor() string {
+    if author := getConfig("user.author"); author != "" {
+        return author
+    }
+    return defaultAuthor
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+
+// A snapshot of files to diff. The files of the working tree are only hashed,
+// so their contents are read from the working tree instead of from blobs.
+type diffSide struct {
+    files   []CommitFile
+    working bool
+}
+
+
+func readDiffFile(side diffSide, name string) string {
+    f, ok := findCommitFile(side.files, name)
+    if !ok {
+        return ""
+    }
+
+    if side.working {
+        root, _ := findLvcRoot()
+        data, err := ioutil.ReadFile(filepath.Join(root, f.name))
+        if err != nil {
+            panic(err)
+        }
+        return string(data)
+    }
+    return string(readBlob(f.id))
+}
+
+
+// Keeps the files matching any of paths, or all files if paths is empty
+func filterDiffFiles(files []CommitFile, paths []string) []CommitFile {
+    if len(paths) == 0 {
+        return files
+    }
+
+    result := make([]CommitFile, 0)
+    for _, path := range paths {
+        for _, f := range filesMatchingPath(files, repoRelativePath(path)) {
+            if _, ok := findCommitFile(result, f.name); !ok {
+                result = append(result, f)
+            }
+        }
+    }
+    return result
+}
+
+
+// Returns the files that differ between from and to, sorted by name
+func changedFiles(from diffSide, to diffSide) []StageEntry {
+    entries := stageEntriesBetween(from.files, to.files)
+    sort.Slice(entries, func(i, j int) bool {
+        return filepath.ToSlash(entries[i].name) < filepath.ToSlash(entries[j].name)
+    })
+    return entries
+}
+
+
+// Prints the unified diff between every file in from and to, including
+// files that only exist on one side
+func diffTrees(w io.Writer, from diffSide, to diffSide, color bool) {
+    for _, e := range changedFiles(from, to) {
+        _, inFrom := findCommitFile(from.files, e.name)
+        _, inTo := findCommitFile(to.files, e.name)
+        oldText := readDiffFile(from, e.name)
+        newText := readDiffFile(to, e.name)
+
+        if isBinary(e.name, []byte(oldText)) || isBinary(e.name, []byte(newText)) {
+            printBinaryFileDiff(w, filepath.ToSlash(e.name), inFrom, inTo,
+                describeBinarySide(from, e.name, len(oldText)), describeBinarySide(to, e.name, len(newText)), color)
+        } else {
+            printFileDiff(w, filepath.ToSlash(e.name), oldText, newText, inFrom, inTo, color)
+        }
+    }
+}
+
+
+// Lines added and removed in a single file, binary files only have sizes
+type fileStat struct {
+    name    string
+    status  string
+    added   int
+    deleted int
+    binary  bool
+    oldSize int
+    newSize int
+}
+
+
+func diffStats(from diffSide, to diffSide) []fileStat {
+    stats := make([]fileStat, 0)
+    for _, e := range changedFiles(from, to) {
+        stat := fileStat{
+            name: filepath.ToSlash(e.name),
+            status: "M",
+        }
+        if _, ok := findCommitFile(from.files, e.name); !ok {
+            stat.status = "A"
+        } else if _, ok := findCommitFile(to.files, e.name); !ok {
+            stat.status = "D"
+        }
+
+        oldText := readDiffFile(from, e.name)
+        newText := readDiffFile(to, e.name)
+        if isBinary(e.name, []byte(oldText)) || isBinary(e.name, []byte(newText)) {
+            stat.binary = true
+            stat.oldSize = len(oldText)
+            stat.newSize = len(newText)
+            stats = append(stats, stat)
+            continue
+        }
+
+        for _, h := range diffHunks(oldText, newText) {
+            stat.added += len(h.lines)
+            stat.deleted += h.end - h.start
+        }
+        stats = append(stats, stat)
+    }
+    return stats
+}
+
+
+// The summary modes print stats instead of the patch
+func statModeSelected() bool {
+    return *flagStat || *flagNumstat || *flagShortstat || *flagNameStatus
+}
+
+
+// Prints the stats in every summary mode selected by the flags
+func printSelectedStats(w io.Writer, stats []fileStat, color bool) {
+    if *flagNameStatus {
+        for _, s := range stats {
+            fmt.Fprintf(w, "%s\t%s\n", s.status, s.name)
+        }
+    }
+    if *flagNumstat {
+        for _, s := range stats {
+            // Changed lines do not apply to binary files
+            if s.binary {
+                fmt.Fprintf(w, "-\t-\t%s\n", s.name)
+            } else {
+                fmt.Fprintf(w, "%d\t%d\t%s\n", s.added, s.deleted, s.name)
+            }
+        }
+    }
+    if *flagStat {
+        printStatHistogram(w, stats, terminalWidth(), color)
+    }
+    if *flagStat || *flagShortstat {
+        printShortstat(w, stats)
+    }
+}
+
+
+// Prints a line per file with the number of changed lines and a bar of
+// '+' and '-', the bars are scaled down to fit in width
+func printStatHistogram(w io.Writer, stats []fileStat, width int, color bool) {
+    nameWidth := 0
+    most := 0
+    for _, s := range stats {
+        if len(s.name) > nameWidth {
+            nameWidth = len(s.name)
+        }
+        if s.added + s.deleted > most {
+            most = s.added + s.deleted
+        }
+    }
+    countWidth := len(strconv.Itoa(most))
+    for _, s := range stats {
+        if s.binary && countWidth < len("Bin") {
+            countWidth = len("Bin")
+        }
+    }
+
+    // " <name> | <count> <bar>"
+    barWidth := width - nameWidth - countWidth - 5
+    if barWidth < 10 {
+        barWidth = 10
+    }
+
+    for _, s := range stats {
+        if s.binary {
+            fmt.Fprintf(w, " %-*s | %*s %d -> %d bytes\n", nameWidth, s.name, countWidth, "Bin", s.oldSize, s.newSize)
+            continue
+        }
+
+        added, deleted := s.added, s.deleted
+        if most > barWidth {
+            added = scaleStat(added, most, barWidth)
+            deleted = scaleStat(deleted, most, barWidth)
+        }
+
+        plus := strings.Repeat("+", added)
+        minus := strings.Repeat("-", deleted)
+        if color {
+            plus = colorGreen + plus + colorReset
+            minus = colorRed + minus + colorReset
+        }
+        fmt.Fprintf(w, " %-*s | %*d %s%s\n", nameWidth, s.name, countWidth, s.added + s.deleted, plus, minus)
+    }
+}
+
+
+// Scales n from [0, most] to [0, width], changes are never scaled away entirely
+func scaleStat(n int, most int, width int) int {
+    if n == 0 {
+        return 0
+    }
+    scaled := n * width / most
+    if scaled == 0 {
+        scaled = 1
+    }
+    return scaled
+}
+
+
+func printShortstat(w io.Writer, stats []fileStat) {
+    added, deleted := 0, 0
+    for _, s := range stats {
+        added += s.added
+        deleted += s.deleted
+    }
+
+    summary := " " + plural(len(stats), "file") + " changed"
+    if added > 0 || len(stats) == 0 {
+        summary += ", " + plural(added, "insertion") + "(+)"
+    }
+    if deleted > 0 || len(stats) == 0 {
+        summary += ", " + plural(deleted, "deletion") + "(-)"
+    }
+    fmt.Fprintln(w, summary)
+}
+
+
+func plural(n int, word string) string {
+    if n == 1 {
+        return "1 " + word
+    }
+    return strconv.Itoa(n) + " " + word + "s"
+}
+
+
+const (
+    colorReset = "\033[0m"
+    colorBold  = "\033[1m"
+    colorRed   = "\033[31m"
+    colorGreen = "\033[32m"
+    colorCyan  = "\033[36m"
+)
+
+
+// Writes a file diff in the unified format read by patch -p1:
+//  diff --git a/<path> b/<path>
+//  new file mode 100644     ; or "deleted file mode 100644"
+//  --- a/<path>             ; or /dev/null for new files
+//  +++ b/<path>             ; or /dev/null for deleted files
+//  @@ -<start>,<count> +<start>,<count> @@
+//  followed by the lines of the hunk prefixed with ' ', '-' or '+'
+func printFileDiff(w io.Writer, path string, oldText string, newText string, oldExists bool, newExists bool, color bool) {
+    header := strings.Builder{}
+    header.WriteString("diff --git a/" + path + " b/" + path + "\n")
+    oldName := "a/" + path
+    newName := "b/" + path
+    if !oldExists {
+        header.WriteString("new file mode 100644\n")
+        oldName = "/dev/null"
+    }
+    if !newExists {
+        header.WriteString("deleted file mode 100644\n")
+        newName = "/dev/null"
+    }
+    header.WriteString("--- " + oldName + "\n")
+    header.WriteString("+++ " + newName + "\n")
+
+    if color {
+        for _, line := range splitLines(header.String()) {
+            fmt.Fprint(w, colorBold + strings.TrimSuffix(line, "\n") + colorReset + "\n")
+        }
+    } else {
+        fmt.Fprint(w, header.String())
+    }
+
+    writeUnifiedHunks(w, splitLines(oldText), diffHunks(oldText, newText), *flagUnified, *flagWordDiff, color)
+}
+
+
+// Writes the header of a binary file diff followed by
+//  Binary files a/<path> and b/<path> differ (<old> -> <new>)
+// where each side is "<size> bytes <hash>", or "none" when the file does not exist
+func printBinaryFileDiff(w io.Writer, path string, oldExists bool, newExists bool, oldSide string, newSide string, color bool) {
+    header := strings.Builder{}
+    header.WriteString("diff --git a/" + path + " b/" + path + "\n")
+    oldName := "a/" + path
+    newName := "b/" + path
+    if !oldExists {
+        header.WriteString("new file mode 100644\n")
+        oldName = "/dev/null"
+    }
+    if !newExists {
+        header.WriteString("deleted file mode 100644\n")
+        newName = "/dev/null"
+    }
+
+    if color {
+        for _, line := range splitLines(header.String()) {
+            fmt.Fprint(w, colorBold + strings.TrimSuffix(line, "\n") + colorReset + "\n")
+        }
+    } else {
+        fmt.Fprint(w, header.String())
+    }
+    fmt.Fprintf(w, "Binary files %s and %s differ (%s -> %s)\n", oldName, newName, oldSide, newSide)
+}
+
+
+// Writes the hunks with context lines around them, hunks closer
+// than twice the context are joined. With a word diff mode the
+// changed lines are written with the changed words marked instead.
+func writeUnifiedHunks(w io.Writer, a []string, hunks []hunk, context int, words wordDiffMode, color bool) {
+    if context < 0 {
+        context = 0
+    }
+
+    // How many lines the new side is ahead of the old side before hunk i
+    delta := 0
+    for i := 0; i < len(hunks); {
+        j := i
+        for j+1 < len(hunks) && hunks[j+1].start - hunks[j].end <= 2*context {
+            j++
+        }
+        group := hunks[i:j+1]
+
+        groupDelta := 0
+        for _, h := range group {
+            groupDelta += len(h.lines) - (h.end - h.start)
+        }
+
+        oldLo := group[0].start - context
+        if oldLo < 0 {
+            oldLo = 0
+        }
+        oldHi := group[len(group)-1].end + context
+        if oldHi > len(a) {
+            oldHi = len(a)
+        }
+        newLo := oldLo + delta
+        newHi := oldHi + delta + groupDelta
+
+        header := "@@ -" + formatHunkRange(oldLo, oldHi - oldLo) + " +" + formatHunkRange(newLo, newHi - newLo) + " @@"
+        if color {
+            header = colorCyan + header + colorReset
+        }
+        fmt.Fprintln(w, header)
+
+        contextPrefix := " "
+        if words != "" {
+            contextPrefix = ""
+        }
+
+        pos := oldLo
+        for _, h := range group {
+            writeDiffLines(w, contextPrefix, a[pos:h.start], "", color)
+            if words != "" {
+                writeWordDiff(w, a[h.start:h.end], h.lines, words)
+            } else {
+                writeDiffLines(w, "-", a[h.start:h.end], colorRed, color)
+                writeDiffLines(w, "+", h.lines, colorGreen, color)
+            }
+            pos = h.end
+        }
+        writeDiffLines(w, contextPrefix, a[pos:oldHi], "", color)
+
+        delta += groupDelta
+        i = j + 1
+    }
+}
+
+
+// Formats the 0-based line lo and count as "<start>,<count>". The count is
+// left out when it is 1, and an empty range starts at the line before it.
+func formatHunkRange(lo int, count int) string {
+    switch count {
+    case 0:
+        return strconv.Itoa(lo) + ",0"
+    case 1:
+        return strconv.Itoa(lo + 1)
+    }
+    return strconv.Itoa(lo + 1) + "," + strconv.Itoa(count)
+}
+
+
+func writeDiffLines(w io.Writer, prefix string, lines []string, lineColor string, color bool) {
+    for _, line := range lines {
+        text := prefix + strings.TrimSuffix(line, "\n")
+        if color && lineColor != "" {
+            text = lineColor + text + colorReset
+        }
+        fmt.Fprintln(w, text)
+
+        if !strings.HasSuffix(line, "\n") {
+            fmt.Fprintln(w, "\\ No newline at end of file")
+        }
+    }
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+
+// Line diffs are computed by one of the algorithms below, selected with
+// --diff-algorithm or the diff.algorithm config option. The selected
+// algorithm is used everywhere lines are diffed: diff, stats and merges.
+//  myers     ; the shortest edit script, the default
+//  patience  ; matches lines that are unique on both sides first, which keeps
+//              moved blocks and repeated lines like braces from being mixed up
+//  histogram ; like patience but matches the rarest lines first, so it
+//              also finds anchors when no line is unique
+
+type diffAlgorithm interface {
+    // Appends the matching lines of a[alo:ahi] and b[blo:bhi], in order
+    match(a []string, b []string, alo int, ahi int, blo int, bhi int, matches []lineMatch) []lineMatch
+}
+
+// Line a of the old side is the same line as line b of the new side
+type lineMatch struct {
+    a int
+    b int
+}
+
+var diffAlgorithms = map[string]diffAlgorithm{
+    "myers": myersDiff{},
+    "patience": patienceDiff{},
+    "histogram": histogramDiff{},
+}
+
+
+func diffAlgorithmByName(name string) (diffAlgorithm, error) {
+    if algorithm, ok := diffAlgorithms[name]; ok {
+        return algorithm, nil
+    }
+    return nil, errors.New("unknown diff algorithm '" + name + "', expected myers, patience or histogram")
+}
+
+
+// Returns the algorithm given by --diff-algorithm, diff.algorithm or myers
+func selectedDiffAlgorithm() diffAlgorithm {
+    name := *flagDiffAlgorithm
+    if name == "" {
+        name = getConfig("diff.algorithm")
+    }
+    if name == "" {
+        name = "myers"
+    }
+
+    algorithm, err := diffAlgorithmByName(name)
+    if err != nil {
+        fmt.Fprintln(os.Stderr, "error: " + err.Error())
+        os.Exit(1)
+    }
+    return algorithm
+}
+
+
+// Returns the hunks that turn a into b, the lines between matches are changed
+func diffLines(algorithm diffAlgorithm, a []string, b []string) []hunk {
+    matches := matchLines(algorithm, a, b, 0, len(a), 0, len(b), make([]lineMatch, 0))
+    // A sentinel past the end closes the last hunk
+    matches = append(matches, lineMatch{a: len(a), b: len(b)})
+
+    hunks := make([]hunk, 0)
+    i, j := 0, 0
+    for _, m := range matches {
+        if m.a > i || m.b > j {
+            hunks = append(hunks, hunk{start: i, end: m.a, lines: append([]string(nil), b[j:m.b]...)})
+        }
+        i, j = m.a + 1, m.b + 1
+    }
+    return hunks
+}
+
+
+// Matches the common prefix and suffix, which every algorithm would
+// match anyway, and lets the algorithm match what is left in between
+func matchLines(algorithm diffAlgorithm, a []string, b []string, alo int, ahi int, blo int, bhi int, matches []lineMatch) []lineMatch {
+    for alo < ahi && blo < bhi && a[alo] == b[blo] {
+        matches = append(matches, lineMatch{a: alo, b: blo})
+        alo++
+        blo++
+    }
+
+    suffix := 0
+    for alo < ahi - suffix && blo < bhi - suffix && a[ahi-suffix-1] == b[bhi-suffix-1] {
+        suffix++
+    }
+
+    if alo < ahi - suffix && blo < bhi - suffix {
+        matches = algorithm.match(a, b, alo, ahi - suffix, blo, bhi - suffix, matches)
+    }
+
+    for k := suffix; k > 0; k-- {
+        matches = append(matches, lineMatch{a: ahi - k, b: bhi - k})
+    }
+    return matches
+}
+
+
+type myersDiff struct{}
+
+// Finds the shortest edit script with Myers' O(ND) algorithm, keeping
+// the furthest reaching paths of every step to trace the matches back
+func (myersDiff) match(a []string, b []string, alo int, ahi int, blo int, bhi int, matches []lineMatch) []lineMatch {
+    n, m := ahi - alo, bhi - blo
+    max := n + m
+    offset := max + 1
+    v := make([]int, 2*max + 3)
+    trace := make([][]int, 0)
+
+    found := false
+    for d := 0; d <= max && !found; d++ {
+        for k := -d; k <= d; k += 2 {
+            var x int
+            if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+                // Insertion, move down from diagonal k+1
+                x = v[offset+k+1]
+            } else {
+                // Deletion, move right from diagonal k-1
+                x = v[offset+k-1] + 1
+            }
+            y := x - k
+            for x < n && y < m && a[alo+x] == b[blo+y] {
+                x++
+                y++
+            }
+            v[offset+k] = x
+
+            if x >= n && y >= m {
+                found = true
+                break
+            }
+        }
+        // Only the diagonals reached so far are kept, the trace is O(D^2)
+        snapshot := make([]int, 2*d + 1)
+        copy(snapshot, v[offset-d:offset+d+1])
+        trace = append(trace, snapshot)
+    }
+
+    // Walk back from the end, collecting the diagonal moves
+    reversed := make([]lineMatch, 0)
+    x, y := n, m
+    for d := len(trace) - 1; d > 0; d-- {
+        // The diagonals of step d-1 start at -(d-1)
+        prev := trace[d-1]
+        at := func(k int) int {
+            return prev[k+d-1]
+        }
+        k := x - y
+        var prevK int
+        if k == -d || (k != d && at(k-1) < at(k+1)) {
+            prevK = k + 1
+        } else {
+            prevK = k - 1
+        }
+        prevX := at(prevK)
+        prevY := prevX - prevK
+
+        for x > prevX && y > prevY {
+            x--
+            y--
+            reversed = append(reversed, lineMatch{a: alo + x, b: blo + y})
+        }
+        x, y = prevX, prevY
+    }
+    // The first snake starts at the top left
+    for x > 0 && y > 0 {
+        x--
+        y--
+        reversed = append(reversed, lineMatch{a: alo + x, b: blo + y})
+    }
+
+    for i := len(reversed) - 1; i >= 0; i-- {
+        matches = append(matches, reversed[i])
+    }
+    return matches
+}
+
+
+type patienceDiff struct{}
+
+// Matches the longest increasing sequence of lines that occur exactly once on
+// both sides, then diffs between those anchors. Falls back to Myers when no
+// line is unique.
+func (patienceDiff) match(a []string, b []string, alo int, ahi int, blo int, bhi int, matches []lineMatch) []lineMatch {
+    type occurrence struct {
+        countA int
+        countB int
+        indexA int
+        indexB int
+    }
+    lines := make(map[string]*occurrence)
+    for i := alo; i < ahi; i++ {
+        o, ok := lines[a[i]]
+        if !ok {
+            o = &occurrence{}
+            lines[a[i]] = o
+        }
+        o.countA++
+        o.indexA = i
+    }
+    for j := blo; j < bhi; j++ {
+        if o, ok := lines[b[j]]; ok {
+            o.countB++
+            o.indexB = j
+        }
+    }
+
+    // Unique lines in the order of b
+    unique := make([]lineMatch, 0)
+    for j := blo; j < bhi; j++ {
+        if o := lines[b[j]]; o != nil && o.countA == 1 && o.countB == 1 {
+            unique = append(unique, lineMatch{a: o.indexA, b: j})
+        }
+    }
+    if len(unique) == 0 {
+        return myersDiff{}.match(a, b, alo, ahi, blo, bhi, matches)
+    }
+
+    for _, anchor := range longestIncreasingRun(unique) {
+        matches = matchLines(patienceDiff{}, a, b, alo, anchor.a, blo, anchor.b, matches)
+        matches = append(matches, anchor)
+        alo, blo = anchor.a + 1, anchor.b + 1
+    }
+    return matchLines(patienceDiff{}, a, b, alo, ahi, blo, bhi, matches)
+}
+
+
+// Returns the longest subsequence of matches, which are ordered by b, that is
+// also ordered by a. This is the patience sorting step of the algorithm.
+func longestIncreasingRun(matches []lineMatch) []lineMatch {
+    // The top of each pile, and the top of the previous pile when each match was placed
+    piles := make([]int, 0)
+    previous := make([]int, len(matches))
+
+    for i, m := range matches {
+        lo, hi := 0, len(piles)
+        for lo < hi {
+            mid := (lo + hi) / 2
+            if matches[piles[mid]].a < m.a {
+                lo = mid + 1
+            } else {
+                hi = mid
+            }
+        }
+
+        previous[i] = -1
+        if lo > 0 {
+            previous[i] = piles[lo-1]
+        }
+        if lo == len(piles) {
+            piles = append(piles, i)
+        } else {
+            piles[lo] = i
+        }
+    }
+
+    result := make([]lineMatch, len(piles))
+    for i, k := len(piles) - 1, piles[len(piles)-1]; i >= 0; i, k = i - 1, previous[k] {
+        result[i] = matches[k]
+    }
+    return result
+}
+
+
+// Lines occurring more often than this on the old side are not used as
+// anchors by the histogram diff, like the limit used by jgit
+const histogramMaxOccurrences = 64
+
+type histogramDiff struct{}
+
+// Finds the longest common run of lines starting with the line that occurs
+// the least on the old side, and diffs before and after it. Falls back to
+// Myers when every common line is too common.
+func (histogramDiff) match(a []string, b []string, alo int, ahi int, blo int, bhi int, matches []lineMatch) []lineMatch {
+    positions := make(map[string][]int)
+    for i := alo; i < ahi; i++ {
+        positions[a[i]] = append(positions[a[i]], i)
+    }
+
+    middle := (blo + bhi) / 2
+    best := lineMatch{a: -1, b: -1}
+    bestLength := 0
+    bestCount := histogramMaxOccurrences + 1
+
+    for j := blo; j < bhi; {
+        next := j + 1
+        candidates := positions[b[j]]
+        if len(candidates) > 0 && len(candidates) <= bestCount {
+            for _, i := range candidates {
+                // Extend the run in both directions, tracking its rarest line
+                start := lineMatch{a: i, b: j}
+                count := len(candidates)
+                for start.a > alo && start.b > blo && a[start.a-1] == b[start.b-1] {
+                    start.a--
+                    start.b--
+                    if c := len(positions[a[start.a]]); c < count {
+                        count = c
+                    }
+                }
+                end := lineMatch{a: i + 1, b: j + 1}
+                for end.a < ahi && end.b < bhi && a[end.a] == b[end.b] {
+                    if c := len(positions[a[end.a]]); c < count {
+                        count = c
+                    }
+                    end.a++
+                    end.b++
+                }
+
+                // Ties go to the longer run, then to the run closest to the
+                // middle which keeps the recursion balanced
+                length := end.a - start.a
+                if count < bestCount || (count == bestCount && (length > bestLength ||
+                        (length == bestLength && absInt(start.b - middle) < absInt(best.b - middle)))) {
+                    best, bestLength, bestCount = start, length, count
+                }
+                if end.b > next {
+                    next = end.b
+                }
+            }
+        }
+        j = next
+    }
+
+    if bestLength == 0 {
+        return myersDiff{}.match(a, b, alo, ahi, blo, bhi, matches)
+    }
+
+    matches = matchLines(histogramDiff{}, a, b, alo, best.a, blo, best.b, matches)
+    for k := 0; k < bestLength; k++ {
+        matches = append(matches, lineMatch{a: best.a + k, b: best.b + k})
+    }
+    return matchLines(histogramDiff{}, a, b, best.a + bestLength, ahi, best.b + bestLength, bhi, matches)
+}
+
+
+func absInt(x int) int {
+    if x < 0 {
+        return -x
+    }
+    return x
+}
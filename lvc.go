@@ -10,26 +10,22 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
 	"time"
-
-	"github.com/sergi/go-diff/diffmatchpatch"
 )
 
 // HEAD -> id of current commit
 // COMMIT -> list of ids of files and their blob data
 // BLOBS -> data
 
-// Could allow blobs for commit messages, identify by prefixng the message with "blob:".
-// make sure to disallow "blob:" in short commit message for this to work
+// Commit messages that span multiple lines, or that start with "blob:", are stored
+// as blobs and the message line in the commit is "blob:<blobid>", see encodeCommitMessage
 
-// TODO: Make stage more stage like, aka make a blob when you stage a file
-// store the hash of that in the stage file and use that in for example
-// lvc diff so that you can see when a staged file has changes.
-// Also useful so that you dont accidentally change files after staging
-// them and having those changes come with the commit.
+// The stage holds a blob for every staged file, created when the file is staged,
+// so changes made to a file after staging it are not committed.
+// stage format:
+//  blobid<space>filename ; one entry for each staged file, a zero blobid means the file is removed
 
 // how are we going to set author? per commit?
 
@@ -53,9 +49,12 @@ import (
 
 // commit format:
 //  commitid ; id of parent commit
-//  commitmsg ; commit message
+//  commitmsg ; commit message, or blob:<blobid> for multi-line messages
 //  author ; cand be anything, probably something like "thebirk <pingnor@gmail.com>"
-//  timestamp ; utc+0 timestamp of commit
+//  timestamp ; timestamp of when the author made the commit, with their utc offset
+//  committer <committer> ; optional, defaults to the author
+//  committer-date <timestamp> ; optional, defaults to the timestamp
+//  signature <publickey> <signature> ; optional, see sign.go
 //  filename<space>blobid ; one entry for each tracked file
 
 // Create a new file object every time a files is changed
@@ -81,12 +80,15 @@ var zeroID = ID([32]byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0
 
 // Commit represents a single commit
 type Commit struct {
-    id        ID
-    parent    ID
-    message   string
-    author    string
-    timestamp time.Time
-    files     []CommitFile
+    id                 ID
+    parent             ID
+    message            string
+    author             string
+    timestamp          time.Time
+    committer          string
+    committerTimestamp time.Time
+    signature          string
+    files              []CommitFile
 }
 
 
@@ -96,6 +98,12 @@ type CommitFile struct {
     id   ID
 }
 
+// StageEntry represents a staged file, id is zeroID when the file is staged for removal
+type StageEntry struct {
+    name string
+    id   ID
+}
+
 // Branch represents a branch and its current commit id
 type Branch struct {
     name string
@@ -103,9 +111,22 @@ type Branch struct {
 }
 
 // Tag represens a tag and its commit id
+// annotation is the id of the TagObject for annotated tags, zeroID otherwise
 type Tag struct {
-    name string
-    id   ID
+    name       string
+    id         ID
+    annotation ID
+}
+
+// TagObject is the object an annotated tag points to
+type TagObject struct {
+    id        ID
+    target    ID
+    name      string
+    tagger    string
+    timestamp time.Time
+    message   string
+    signature string
 }
 
 
@@ -154,9 +175,15 @@ func createBlob(data []byte) ID {
     id := ID(sha256.Sum256(data))
     name := hex.EncodeToString(id[:])
 
-    //TODO: Check if blob already exists, if so, we can skip writing it again
+    root, _ := findLvcRoot()
+    path := filepath.Join(root, ".lvc/blobs/", name)
+
+    // Blobs are content addressed, so an existing blob already has this data
+    if refExists(path) {
+        return id
+    }
 
-    if err := ioutil.WriteFile(name, data, 0644); err != nil {
+    if err := ioutil.WriteFile(path, data, 0644); err != nil {
         panic(err)
     }
 
@@ -164,6 +191,71 @@ func createBlob(data []byte) ID {
 }
 
 
+func readBlob(id ID) []byte {
+    root, _ := findLvcRoot()
+    data, err := ioutil.ReadFile(filepath.Join(root, ".lvc/blobs/", hex.EncodeToString(id[:])))
+    if err != nil {
+        panic(err)
+    }
+    return data
+}
+
+
+// Returns the line to store in the commit for msg
+func encodeCommitMessage(msg string) string {
+    if strings.ContainsAny(msg, "\r\n") || strings.HasPrefix(msg, "blob:") {
+        id := createBlob([]byte(msg))
+        return "blob:" + hex.EncodeToString(id[:])
+    }
+    return msg
+}
+
+
+func decodeCommitMessage(line string) string {
+    if !strings.HasPrefix(line, "blob:") {
+        return line
+    }
+
+    idBytes, err := hex.DecodeString(strings.TrimPrefix(line, "blob:"))
+    if err != nil || len(idBytes) != len(ID{}) {
+        return line
+    }
+    id := ID{}
+    copy(id[:], idBytes)
+
+    return string(readBlob(id))
+}
+
+
+// Returns the first line of a commit message
+func messageSubject(msg string) string {
+    if nl := strings.IndexAny(msg, "\r\n"); nl != -1 {
+        return msg[:nl]
+    }
+    return msg
+}
+
+
+// Strips trailing whitespace and surrounding empty lines from a message,
+// and '#' comment lines when it was written in the editor. Runs of empty
+// lines are collapsed into one.
+func cleanupMessage(msg string, stripComments bool) string {
+    lines := make([]string, 0)
+    for _, line := range strings.Split(strings.Replace(msg, "\r\n", "\n", -1), "\n") {
+        if stripComments && strings.HasPrefix(line, "#") {
+            continue
+        }
+        line = strings.TrimRight(line, " \t")
+        if line == "" && len(lines) > 0 && lines[len(lines)-1] == "" {
+            continue
+        }
+        lines = append(lines, line)
+    }
+
+    return strings.Trim(strings.Join(lines, "\n"), "\n")
+}
+
+
 func pathIsValidRepo(path string) bool {
     dir, err := os.Open(path);
     if err != nil {
@@ -204,15 +296,8 @@ func pathIsChildOfRoot(path string) bool {
 func stageFiles(files []string) {
     root, _ := findLvcRoot()
 
-    sw, err := os.OpenFile(filepath.Join(root, ".lvc", "stage"), os.O_APPEND|os.O_WRONLY, 0644)
-    if err != nil {
-        //TODO
-        panic(err)
-    }
-
-    stagedFiles := readStageFile()
+    entries := readStage()
 
-    file_loop:
     for _, f := range files {
         if !pathIsChildOfRoot(f) {
             fmt.Fprintln(os.Stderr, "error: '" + f + "' is outside the repository")
@@ -233,28 +318,63 @@ func stageFiles(files []string) {
 
         //TODO: Check if 'f' is inside OUR .lvc, if so ignore it
 
-        for _, sf := range stagedFiles {
-            if pathsAreEqual(sf, f) {
-                continue file_loop
-            }
-        }
+        rel := repoRelativePath(f)
+        abs := filepath.Join(root, rel)
 
-        abs, err := filepath.Abs(f)
-        if err != nil {
-            panic(err)
-        }
-        rel, err := filepath.Rel(root, abs)
-        if err != nil {
-            panic(err)
-        }
-        sw.WriteString(rel + "\n")
+        id := getFileHash(abs)
+        createBlobForFileWithID(abs, id)
+        entries = setStageEntry(entries, StageEntry{
+            name: rel,
+            id: id,
+        })
+        resolveConflict(rel)
 
         fmt.Println("Staged " + rel + "")
     }
+
+    writeStage(entries)
 }
 
 
-func readStageFile() []string {
+// Returns path relative to the root of the repository
+func repoRelativePath(path string) string {
+    root, _ := findLvcRoot()
+
+    abs, err := filepath.Abs(path)
+    if err != nil {
+        panic(err)
+    }
+    rel, err := filepath.Rel(root, abs)
+    if err != nil {
+        panic(err)
+    }
+    return rel
+}
+
+
+// Replaces the entry for the same file, or appends it if the file is not staged
+func setStageEntry(entries []StageEntry, entry StageEntry) []StageEntry {
+    for i, e := range entries {
+        if pathsAreEqual(e.name, entry.name) {
+            entries[i] = entry
+            return entries
+        }
+    }
+    return append(entries, entry)
+}
+
+
+func removeStageEntry(entries []StageEntry, name string) ([]StageEntry, bool) {
+    for i, e := range entries {
+        if pathsAreEqual(e.name, name) {
+            return append(entries[:i], entries[i+1:]...), true
+        }
+    }
+    return entries, false
+}
+
+
+func readStage() []StageEntry {
     root, _ := findLvcRoot()
     stageReader, err := os.Open(filepath.Join(root, ".lvc", "stage"))
     if err != nil {
@@ -263,18 +383,133 @@ func readStageFile() []string {
     }
     defer stageReader.Close()
 
-    files := make([]string, 0)
+    entries := make([]StageEntry, 0)
     scanner := bufio.NewScanner(stageReader)
     for scanner.Scan() {
-        files = append(files, scanner.Text())
+        line := scanner.Text()
+
+        if !isCommitFileLine(line) {
+            // Older stages only held the file name, the file is staged as it is now
+            id := getFileHash(filepath.Join(root, line))
+            createBlobForFileWithID(filepath.Join(root, line), id)
+            entries = append(entries, StageEntry{
+                name: line,
+                id: id,
+            })
+            continue
+        }
+
+        idBytes, err := hex.DecodeString(line[:64])
+        if err != nil {
+            panic(err)
+        }
+        entry := StageEntry{
+            name: line[65:],
+        }
+        copy(entry.id[:], idBytes)
+        entries = append(entries, entry)
+    }
+
+    return entries
+}
+
+
+func writeStage(entries []StageEntry) {
+    builder := strings.Builder{}
+    for _, e := range entries {
+        builder.WriteString(hex.EncodeToString(e.id[:]) + " " + e.name + "\n")
+    }
+
+    root, _ := findLvcRoot()
+    if err := writeFile(filepath.Join(root, ".lvc", "stage"), builder.String()); err != nil {
+        panic(err)
+    }
+}
+
+
+func readStageFile() []string {
+    files := make([]string, 0)
+    for _, e := range readStage() {
+        files = append(files, e.name)
+    }
+    return files
+}
+
+
+// Returns the files of base with the stage entries applied
+func applyStage(base []CommitFile, entries []StageEntry) []CommitFile {
+    files := make([]CommitFile, 0, len(base))
+
+    baseLoop:
+    for _, f := range base {
+        for _, e := range entries {
+            if pathsAreEqual(f.name, e.name) {
+                continue baseLoop
+            }
+        }
+        files = append(files, f)
+    }
+
+    for _, e := range entries {
+        if e.id != zeroID {
+            files = append(files, CommitFile{
+                name: e.name,
+                id: e.id,
+            })
+        }
     }
 
     return files
 }
 
 
+// Returns the files as they would be committed right now
+func getStagedFiles() []CommitFile {
+    return applyStage(getHead().files, readStage())
+}
+
+
+// Returns the stage entries needed to turn the files in base into the files in target
+func stageEntriesBetween(base []CommitFile, target []CommitFile) []StageEntry {
+    entries := make([]StageEntry, 0)
+
+    for _, t := range target {
+        if b, ok := findCommitFile(base, t.name); !ok || b.id != t.id {
+            entries = append(entries, StageEntry{
+                name: t.name,
+                id: t.id,
+            })
+        }
+    }
+
+    for _, b := range base {
+        if _, ok := findCommitFile(target, b.name); !ok {
+            entries = append(entries, StageEntry{
+                name: b.name,
+                id: zeroID,
+            })
+        }
+    }
+
+    return entries
+}
+
+
+func findCommitFile(files []CommitFile, name string) (CommitFile, bool) {
+    for _, f := range files {
+        if pathsAreEqual(f.name, name) {
+            return f, true
+        }
+    }
+    return CommitFile{}, false
+}
+
+
+// Returns the tracked files that differ from their staged version
 func getModifiedFiles() []string {
-    trackedFiles := getHead()
+    trackedFiles := Commit{
+        files: getStagedFiles(),
+    }
 
     files := make([]string, 0)
 
@@ -311,6 +546,27 @@ func getModifiedFiles() []string {
 }
 
 
+// Returns the tracked files as they are in the working tree, files that
+// have been removed from the working tree are left out. The files are only
+// hashed, use createBlobForFileWithID to store them.
+func getWorkingFiles() []CommitFile {
+    root, _ := findLvcRoot()
+
+    files := make([]CommitFile, 0)
+    for _, f := range getStagedFiles() {
+        path := filepath.Join(root, f.name)
+        if info, err := os.Stat(path); err != nil || info.IsDir() {
+            continue
+        }
+        files = append(files, CommitFile{
+            name: f.name,
+            id: getFileHash(path),
+        })
+    }
+    return files
+}
+
+
 func getFileHash(path string) ID {
     f, err := os.Open(path)
     if err != nil {
@@ -344,44 +600,16 @@ func createBlobForFileWithID(path string, id ID) {
 
 
 func getCommitWithoutFiles(id ID) Commit {
-    root, _ := findLvcRoot()
-    reader, err := os.Open(filepath.Join(root, ".lvc/commits/", hex.EncodeToString(id[:])))
-    if err != nil {
-        //TODO: Handle
-        panic(err)
-    }
-    defer reader.Close()
-
-    commit := Commit{}
-    commit.id = id
-
-    scanner := bufio.NewScanner(reader)
-
-    // parent
-    scanner.Scan()
-    parentID, err := hex.DecodeString(scanner.Text())
-    if err != nil {
-        panic(err)
-    }
-    copy(commit.parent[:], parentID)
-
-    scanner.Scan()
-    commit.message = scanner.Text()
-
-    scanner.Scan()
-    commit.author = scanner.Text()
+    return readCommit(id, false)
+}
 
-    scanner.Scan()
-    commit.timestamp, err = time.Parse(time.RFC3339, scanner.Text())
-    if err != nil {
-        panic(err)
-    }
 
-    return commit
+func getCommit(id ID) Commit {
+    return readCommit(id, true)
 }
 
 
-func getCommit(id ID) Commit {
+func readCommit(id ID, withFiles bool) Commit {
     root, _ := findLvcRoot()
     reader, err := os.Open(filepath.Join(root, ".lvc/commits/", hex.EncodeToString(id[:])))
     if err != nil {
@@ -404,7 +632,7 @@ func getCommit(id ID) Commit {
     copy(commit.parent[:], parentID)
 
     scanner.Scan()
-    commit.message = scanner.Text()
+    commit.message = decodeCommitMessage(scanner.Text())
 
     scanner.Scan()
     commit.author = scanner.Text()
@@ -415,9 +643,37 @@ func getCommit(id ID) Commit {
         panic(err)
     }
 
+    // Older commits have no committer, it was always the author
+    commit.committer = commit.author
+    commit.committerTimestamp = commit.timestamp
+
     commit.files = make([]CommitFile, 0)
 
     for scanner.Scan() {
+        if !isCommitFileLine(scanner.Text()) {
+            header := strings.SplitN(scanner.Text(), " ", 2)
+            if len(header) != 2 {
+                continue
+            }
+
+            switch header[0] {
+            case "committer":
+                commit.committer = header[1]
+            case "committer-date":
+                commit.committerTimestamp, err = time.Parse(time.RFC3339, header[1])
+                if err != nil {
+                    panic(err)
+                }
+            case "signature":
+                commit.signature = header[1]
+            }
+            continue
+        }
+
+        if !withFiles {
+            break
+        }
+
         line := strings.SplitN(scanner.Text(), " ", 2)
         sid, err := hex.DecodeString(line[0])
         if err != nil {
@@ -435,111 +691,308 @@ func getCommit(id ID) Commit {
 }
 
 
-func getHeadID() ID {
-    root, _ := findLvcRoot()
-    headBytes, err := ioutil.ReadFile(filepath.Join(root, ".lvc/head"))
-    if err != nil {
-        panic(err)
+func encodeCommit(commit Commit) string {
+    builder := strings.Builder{}
+    builder.WriteString(hex.EncodeToString(commit.parent[:]) + "\n")
+    builder.WriteString(encodeCommitMessage(commit.message) + "\n")
+    builder.WriteString(commit.author + "\n")
+    builder.WriteString(commit.timestamp.Format(time.RFC3339) + "\n")
+    builder.WriteString("committer " + commit.committer + "\n")
+    builder.WriteString("committer-date " + commit.committerTimestamp.Format(time.RFC3339) + "\n")
+    if commit.signature != "" {
+        builder.WriteString("signature " + commit.signature + "\n")
     }
-    // Chop of newline
-    head := string(headBytes[:len(headBytes)-1])
-
-    if _, err := os.Stat(filepath.Join(root, ".lvc/branches/", head)); os.IsNotExist(err) {
-        fmt.Fprintln(os.Stderr, "error: unknown branch '" + head + "'")
-        os.Exit(1)
+    for _, c := range commit.files {
+        builder.WriteString(hex.EncodeToString(c.id[:]) + " " + c.name + "\n")
     }
+    return builder.String()
+}
 
-    branchBytes, err := ioutil.ReadFile(filepath.Join(root, ".lvc/branches/", head))
-    if err != nil {
-        panic(err)
-    }
-    // Chop of newline at the end
-    branch := string(branchBytes[:len(branchBytes)-1])
 
-    sliceID, err := hex.DecodeString(branch)
-    if err != nil {
+// Signs and stores the commit, returns its id
+func writeCommit(commit Commit) ID {
+    // The signature covers everything but the signature line itself
+    commit.signature = ""
+    commit.signature = signPayload(encodeCommit(commit))
+
+    final := encodeCommit(commit)
+    id := ID(sha256.Sum256([]byte(final)))
+
+    root, _ := findLvcRoot()
+    if err := ioutil.WriteFile(filepath.Join(root, ".lvc/commits/", hex.EncodeToString(id[:])), []byte(final), 0644); err != nil {
         panic(err)
     }
 
-    id := ID{}
-    copy(id[:], sliceID[:])
-
     return id
 }
 
 
-func getHead() Commit {
-    id := getHeadID()
-    return getCommit(id)
+// Branch and tag names may contain slashes, e.g. "feature/login", in which
+// case they are stored as nested files under .lvc/branches and .lvc/tags.
+func branchPath(name string) string {
+    root, _ := findLvcRoot()
+    return filepath.Join(root, ".lvc/branches/", filepath.FromSlash(name))
 }
 
 
-func getBranchID(name string) ID {
+func tagPath(name string) string {
     root, _ := findLvcRoot()
-    if _, err := os.Open(filepath.Join(root, ".lvc/branches/", name)); os.IsNotExist(err) {
-        fmt.Fprintln(os.Stderr, "error: unknown branch '" + name + "'")
-        os.Exit(1)
-    }
+    return filepath.Join(root, ".lvc/tags/", filepath.FromSlash(name))
+}
 
-    branchBytes, err := ioutil.ReadFile(filepath.Join(root, ".lvc/branches/", name))
-    if err != nil {
-        panic(err)
-    }
-    // Chop of newline
-    branchIDString := string(branchBytes[:len(branchBytes)-1])
 
-    branchIDBytes, err := hex.DecodeString(branchIDString)
-    if err != nil {
-        panic(err)
-    }
+// A ref only exists if it is a regular file, directories are just namespaces
+func refExists(path string) bool {
+    info, err := os.Stat(path)
+    return err == nil && info.Mode().IsRegular()
+}
 
-    id := ID{}
-    copy(id[:], branchIDBytes)
 
-    return id
+func writeRef(path string, id ID) error {
+    if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+        return err
+    }
+    return ioutil.WriteFile(path, []byte(hex.EncodeToString(id[:]) + "\n"), 0644)
 }
 
 
-func getBranch(name string) Commit {
-    id := getBranchID(name)
-    return getCommit(id)
-}
+// Returns the names of all refs below dir, using '/' as the separator
+func listRefNames(dir string) []string {
+    names := make([]string, 0)
 
+    err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+        if err != nil {
+            return err
+        }
+        if info.IsDir() {
+            return nil
+        }
 
-func getBranchFromHead() Branch {
+        rel, err := filepath.Rel(dir, path)
+        if err != nil {
+            return err
+        }
+        names = append(names, filepath.ToSlash(rel))
+
+        return nil
+    })
+    if err != nil {
+        panic(err)
+    }
+
+    return names
+}
+
+
+func validateRefName(name string) error {
+    if name == "" {
+        return errors.New("name is empty")
+    }
+    // HEAD is reserved, it would make the revision HEAD and the HEAD reflog ambiguous
+    if name == "HEAD" {
+        return errors.New("name cannot be 'HEAD'")
+    }
+    if strings.HasPrefix(name, "-") {
+        return errors.New("name cannot start with '-'")
+    }
+    if strings.HasSuffix(name, ".lock") {
+        return errors.New("name cannot end with '.lock'")
+    }
+    if strings.Contains(name, "..") {
+        return errors.New("name cannot contain '..'")
+    }
+    if strings.Contains(name, "@{") {
+        return errors.New("name cannot contain '@{'")
+    }
+    if strings.ContainsAny(name, " \t\n\\~^:?*[") {
+        return errors.New("name contains an invalid character")
+    }
+
+    for _, part := range strings.Split(name, "/") {
+        if part == "" {
+            return errors.New("name cannot contain empty components")
+        }
+        if strings.HasPrefix(part, ".") || strings.HasSuffix(part, ".") {
+            return errors.New("components cannot start or end with '.'")
+        }
+    }
+
+    return nil
+}
+
+
+// Refs are files below .lvc, so every name given by the user has to be
+// validated before it is joined onto a path, not only when creating a ref
+func assumeValidRefName(kind string, name string) {
+    if err := validateRefName(name); err != nil {
+        fmt.Fprintln(os.Stderr, "error: invalid " + kind + " name '" + name + "': " + err.Error())
+        os.Exit(1)
+    }
+}
+
+
+// Checks whether name would clash with one of the existing refs, 'a' and 'a/b'
+// cannot coexist since 'a' would have to be both a file and a directory.
+// Returns the conflicting ref or an empty string.
+func findRefConflict(existing []string, name string) string {
+    for _, e := range existing {
+        if strings.HasPrefix(e, name + "/") || strings.HasPrefix(name, e + "/") {
+            return e
+        }
+    }
+    return ""
+}
+
+
+// HEAD is normally the name of the current branch, but while a rebase is in
+// progress it is detached and holds the id of the commit being built on instead
+func readHeadFile() string {
     root, _ := findLvcRoot()
     headBytes, err := ioutil.ReadFile(filepath.Join(root, ".lvc/head"))
     if err != nil {
         panic(err)
     }
     // Chop of newline
-    headString := string(headBytes[:len(headBytes)-1])
+    return string(headBytes[:len(headBytes)-1])
+}
 
-    return Branch{
-        name: headString,
-        id: getBranchID(headString),
+
+func isHeadDetached() bool {
+    head := readHeadFile()
+    if refExists(branchPath(head)) {
+        return false
     }
+    _, err := idFromHex(head)
+    return err == nil
 }
 
 
-func updateBranch(name string, id ID) {
+// Points HEAD directly at the commit id, reason is logged in the HEAD reflog
+func detachHead(id ID, reason string) {
+    old := getHeadID()
+
     root, _ := findLvcRoot()
-    if _, err := os.Open(filepath.Join(root, ".lvc/branches/", name)); os.IsNotExist(err) {
+    if err := writeFile(filepath.Join(root, ".lvc/head"), hex.EncodeToString(id[:]) + "\n"); err != nil {
+        panic(err)
+    }
+
+    appendReflog("HEAD", old, id, reason)
+}
+
+
+func getHeadID() ID {
+    head := readHeadFile()
+
+    if isHeadDetached() {
+        id, _ := idFromHex(head)
+        return id
+    }
+
+    if !refExists(branchPath(head)) {
+        fmt.Fprintln(os.Stderr, "error: unknown branch '" + head + "'")
+        os.Exit(1)
+    }
+
+    branchBytes, err := ioutil.ReadFile(branchPath(head))
+    if err != nil {
+        panic(err)
+    }
+    // Chop of newline at the end
+    branch := string(branchBytes[:len(branchBytes)-1])
+
+    sliceID, err := hex.DecodeString(branch)
+    if err != nil {
+        panic(err)
+    }
+
+    id := ID{}
+    copy(id[:], sliceID[:])
+
+    return id
+}
+
+
+func getHead() Commit {
+    id := getHeadID()
+    return getCommit(id)
+}
+
+
+func getBranchID(name string) ID {
+    assumeValidRefName("branch", name)
+    if !refExists(branchPath(name)) {
         fmt.Fprintln(os.Stderr, "error: unknown branch '" + name + "'")
         os.Exit(1)
     }
 
+    branchBytes, err := ioutil.ReadFile(branchPath(name))
+    if err != nil {
+        panic(err)
+    }
+    // Chop of newline
+    branchIDString := string(branchBytes[:len(branchBytes)-1])
+
+    branchIDBytes, err := hex.DecodeString(branchIDString)
+    if err != nil {
+        panic(err)
+    }
+
+    id := ID{}
+    copy(id[:], branchIDBytes)
+
+    return id
+}
+
+
+func getBranch(name string) Commit {
+    id := getBranchID(name)
+    return getCommit(id)
+}
+
+
+// Returns the current branch, its name is empty if HEAD is detached
+func getBranchFromHead() Branch {
+    if isHeadDetached() {
+        return Branch{
+            id: getHeadID(),
+        }
+    }
+
+    headString := readHeadFile()
+
+    return Branch{
+        name: headString,
+        id: getBranchID(headString),
+    }
+}
+
+
+// Moves the branch to id, reason is logged in the reflog of the branch,
+// and of HEAD if the branch is checked out
+func updateBranch(name string, id ID, reason string) {
+    old := getBranchID(name)
+
     // WriteFile truncates
-    err := ioutil.WriteFile(filepath.Join(root, ".lvc/branches/", name), []byte(hex.EncodeToString(id[:]) + "\n"), 0644)
+    err := ioutil.WriteFile(branchPath(name), []byte(hex.EncodeToString(id[:]) + "\n"), 0644)
     if err != nil {
         panic(err)
     }
+
+    appendReflog(name, old, id, reason)
+    if readHeadFile() == name {
+        appendReflog("HEAD", old, id, reason)
+    }
 }
 
 
-func updateHead(id ID) {
+func updateHead(id ID, reason string) {
+    if isHeadDetached() {
+        detachHead(id, reason)
+        return
+    }
+
     currentBranch := getBranchFromHead()
-    updateBranch(currentBranch.name, id)
+    updateBranch(currentBranch.name, id, reason)
 }
 
 
@@ -552,22 +1005,173 @@ func clearStage() {
 }
 
 
+type resetMode int
+
+const (
+    resetSoft resetMode = iota
+    resetMixed
+    resetHard
+)
+
+// Moves the current branch to id. A soft reset leaves the stage and working
+// tree as they are, so everything that differs from id is staged. A mixed reset
+// also clears the stage, and a hard reset also makes the working tree match id.
+func resetHead(id ID, mode resetMode) {
+    oldFiles := getStagedFiles()
+    target := getCommit(id)
+
+    updateHead(id, "reset: moving to " + hex.EncodeToString(id[:]))
+
+    switch mode {
+    case resetSoft:
+        writeStage(stageEntriesBetween(target.files, oldFiles))
+    case resetMixed:
+        clearStage()
+    case resetHard:
+        clearStage()
+        updateWorkingTree(oldFiles, target.files)
+    }
+}
+
+
+// Unstages a single file, leaving it as it is in the working tree
+func unstageFile(name string) bool {
+    entries, found := removeStageEntry(readStage(), name)
+    if found {
+        writeStage(entries)
+    }
+    return found
+}
+
+
+// Makes the working tree go from the files in from to the files in to.
+// Files that are in neither are untracked and left alone.
+func updateWorkingTree(from []CommitFile, to []CommitFile) {
+    root, _ := findLvcRoot()
+
+    for _, f := range from {
+        if _, ok := findCommitFile(to, f.name); !ok {
+            err := removeFileAndEmptyDirs(root, filepath.Join(root, f.name))
+            if err != nil && !os.IsNotExist(err) {
+                panic(err)
+            }
+        }
+    }
+
+    for _, f := range to {
+        path := filepath.Join(root, f.name)
+        if info, err := os.Stat(path); err == nil && !info.IsDir() && getFileHash(path) == f.id {
+            continue
+        }
+        if err := writeBlobToFile(f.id, path); err != nil {
+            panic(err)
+        }
+    }
+}
+
+
+// Returns the files matching path, which is either a file or a directory
+func filesMatchingPath(files []CommitFile, path string) []CommitFile {
+    prefix := strings.TrimSuffix(filepath.ToSlash(path), "/") + "/"
+
+    matches := make([]CommitFile, 0)
+    for _, f := range files {
+        if pathsAreEqual(f.name, path) || path == "." || strings.HasPrefix(filepath.ToSlash(f.name), prefix) {
+            matches = append(matches, f)
+        }
+    }
+    return matches
+}
+
+
+// Writes the contents of the files in source matching path to the working tree
+func restoreWorkingFiles(source []CommitFile, path string) []CommitFile {
+    root, _ := findLvcRoot()
+
+    matches := filesMatchingPath(source, path)
+    for _, f := range matches {
+        if err := writeBlobToFile(f.id, filepath.Join(root, f.name)); err != nil {
+            panic(err)
+        }
+    }
+    return matches
+}
+
+
+// Stages the files in source matching path, files matching path that are
+// tracked but not in source are staged for removal
+func restoreStagedFiles(source []CommitFile, path string) []CommitFile {
+    head := getHead()
+    entries := readStage()
+
+    matches := filesMatchingPath(source, path)
+    for _, f := range matches {
+        if hf, ok := findCommitFile(head.files, f.name); ok && hf.id == f.id {
+            entries, _ = removeStageEntry(entries, f.name)
+        } else {
+            entries = setStageEntry(entries, StageEntry{
+                name: f.name,
+                id: f.id,
+            })
+        }
+    }
+
+    for _, f := range filesMatchingPath(applyStage(head.files, entries), path) {
+        if _, ok := findCommitFile(source, f.name); ok {
+            continue
+        }
+
+        if _, ok := findCommitFile(head.files, f.name); ok {
+            entries = setStageEntry(entries, StageEntry{
+                name: f.name,
+                id: zeroID,
+            })
+        } else {
+            entries, _ = removeStageEntry(entries, f.name)
+        }
+        matches = append(matches, f)
+    }
+
+    writeStage(entries)
+    return matches
+}
+
+
+func writeBlobToFile(id ID, path string) error {
+    root, _ := findLvcRoot()
+    if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+        return err
+    }
+    return copyFile(filepath.Join(root, ".lvc/blobs/", hex.EncodeToString(id[:])), path)
+}
+
+
 func createNewBranchFromHead(name string) {
+    if err := validateRefName(name); err != nil {
+        fmt.Fprintln(os.Stderr, "error: invalid branch name '" + name + "': " + err.Error())
+        os.Exit(1)
+    }
+
     branches := getAllBranches()
+    names := make([]string, 0, len(branches))
     for _, b := range branches {
         if b.name == name {
             fmt.Fprintln(os.Stderr, "error: branch '" + name + "' already exists")
             os.Exit(1)
         }
+        names = append(names, b.name)
     }
 
-    root, _ := findLvcRoot()
+    if conflict := findRefConflict(names, name); conflict != "" {
+        fmt.Fprintln(os.Stderr, "error: cannot create branch '" + name + "', it conflicts with existing branch '" + conflict + "'")
+        os.Exit(1)
+    }
 
     id := getHeadID()
-    err := ioutil.WriteFile(filepath.Join(root, ".lvc/branches/", name), []byte(hex.EncodeToString(id[:]) + "\n"), 0644)
-    if err != nil {
+    if err := writeRef(branchPath(name), id); err != nil {
         panic(err)
     }
+    appendReflog(name, zeroID, id, "branch: created from " + hex.EncodeToString(id[:]))
 }
 
 
@@ -575,43 +1179,188 @@ func getAllBranches() []Branch {
     result := make([]Branch, 0)
     root, _ := findLvcRoot()
 
-    fileinfos, err := ioutil.ReadDir(filepath.Join(root, ".lvc/branches"))
-    for _, fi := range fileinfos {
-        name := fi.Name()
+    for _, name := range listRefNames(filepath.Join(root, ".lvc/branches")) {
         result = append(result, Branch{
             name: name,
             id: getBranchID(name),
         })
     }
-    if err != nil {
-        panic(err)
-    }
 
     return result
 }
 
 
-func createTagAtHead(name string) {
-    root, _ := findLvcRoot()
+// Points the tag name at target, an existing tag is only overwritten when force is set
+func createTag(name string, target ID, annotation *TagObject, force bool) {
+    assumeValidRefName("tag", name)
 
-    if _, err := os.Open(filepath.Join(root, ".lvc/tags/", name)); !os.IsNotExist(err) {
+    if refExists(tagPath(name)) && !force {
         fmt.Fprintln(os.Stderr, "error: tag '" + name + "' already exists")
         os.Exit(1)
     }
-    headID := getHeadID()
 
-    ioutil.WriteFile(filepath.Join(root, ".lvc/tags/", name), []byte(hex.EncodeToString(headID[:]) + "\n"), 0644)
+    root, _ := findLvcRoot()
+    if conflict := findRefConflict(listRefNames(filepath.Join(root, ".lvc/tags")), name); conflict != "" {
+        fmt.Fprintln(os.Stderr, "error: cannot create tag '" + name + "', it conflicts with existing tag '" + conflict + "'")
+        os.Exit(1)
+    }
+
+    // Lightweight tags point directly at the commit, annotated tags point
+    // at a tag object which in turn points at the commit
+    refID := target
+    if annotation != nil {
+        annotation.target = target
+        annotation.name = name
+        refID = writeTagObject(*annotation)
+    }
+
+    old := zeroID
+    reason := "tag: created"
+    if refExists(tagPath(name)) {
+        old = getTagRefID(name)
+        reason = "tag: moved"
+    }
+
+    if err := writeRef(tagPath(name), refID); err != nil {
+        panic(err)
+    }
+    appendTagReflog(name, old, refID, reason)
 }
 
 
-func getTagID(name string) ID {
+// Removes the tag, reason is logged in the reflog of the tag
+func deleteTag(name string, reason string) {
+    assumeValidRefName("tag", name)
+    if !refExists(tagPath(name)) {
+        fmt.Fprintln(os.Stderr, "error: unknown tag '" + name + "'")
+        os.Exit(1)
+    }
+
+    old := getTagRefID(name)
+    root, _ := findLvcRoot()
+    if err := removeFileAndEmptyDirs(filepath.Join(root, ".lvc/tags"), tagPath(name)); err != nil {
+        panic(err)
+    }
+    appendTagReflog(name, old, zeroID, reason)
+}
+
+
+// tag object format:
+//  object <commitid>
+//  tag <name>
+//  tagger <tagger>
+//  date <timestamp>
+//  signature <publickey> <signature> ; optional, see sign.go
+//  <empty line>
+//  message ; the rest of the file, may span multiple lines
+func encodeTagObject(tag TagObject) string {
+    builder := strings.Builder{}
+    builder.WriteString("object " + hex.EncodeToString(tag.target[:]) + "\n")
+    builder.WriteString("tag " + tag.name + "\n")
+    builder.WriteString("tagger " + tag.tagger + "\n")
+    builder.WriteString("date " + tag.timestamp.Format(time.RFC3339) + "\n")
+    if tag.signature != "" {
+        builder.WriteString("signature " + tag.signature + "\n")
+    }
+    builder.WriteString("\n")
+    builder.WriteString(tag.message)
+    if !strings.HasSuffix(tag.message, "\n") {
+        builder.WriteString("\n")
+    }
+    return builder.String()
+}
+
+
+func writeTagObject(tag TagObject) ID {
+    root, _ := findLvcRoot()
+
+    tag.signature = signPayload(encodeTagObject(tag))
+
+    data := []byte(encodeTagObject(tag))
+    id := ID(sha256.Sum256(data))
+
+    // Repositories created before annotated tags existed lack this directory
+    dir := filepath.Join(root, ".lvc/tagobjects/")
+    if err := os.MkdirAll(dir, 0777); err != nil {
+        panic(err)
+    }
+    if err := ioutil.WriteFile(filepath.Join(dir, hex.EncodeToString(id[:])), data, 0644); err != nil {
+        panic(err)
+    }
+
+    return id
+}
+
+
+func tagObjectExists(id ID) bool {
+    root, _ := findLvcRoot()
+    return refExists(filepath.Join(root, ".lvc/tagobjects/", hex.EncodeToString(id[:])))
+}
+
+
+func getTagObject(id ID) TagObject {
     root, _ := findLvcRoot()
-    if _, err := os.Open(filepath.Join(root, ".lvc/tags/", name)); os.IsNotExist(err) {
+    data, err := ioutil.ReadFile(filepath.Join(root, ".lvc/tagobjects/", hex.EncodeToString(id[:])))
+    if err != nil {
+        panic(err)
+    }
+
+    tag := TagObject{}
+    tag.id = id
+
+    text := string(data)
+    for {
+        nl := strings.Index(text, "\n")
+        if nl == -1 {
+            break
+        }
+        line := text[:nl]
+        text = text[nl+1:]
+        if line == "" {
+            // headers end at the first empty line, the rest is the message
+            break
+        }
+
+        kv := strings.SplitN(line, " ", 2)
+        if len(kv) != 2 {
+            continue
+        }
+
+        switch kv[0] {
+        case "object":
+            target, err := hex.DecodeString(kv[1])
+            if err != nil {
+                panic(err)
+            }
+            copy(tag.target[:], target)
+        case "tag":
+            tag.name = kv[1]
+        case "tagger":
+            tag.tagger = kv[1]
+        case "date":
+            tag.timestamp, err = time.Parse(time.RFC3339, kv[1])
+            if err != nil {
+                panic(err)
+            }
+        case "signature":
+            tag.signature = kv[1]
+        }
+    }
+    tag.message = text
+
+    return tag
+}
+
+
+// Returns the id stored in the tag ref, this is the tag object for annotated tags
+func getTagRefID(name string) ID {
+    assumeValidRefName("tag", name)
+    if !refExists(tagPath(name)) {
         fmt.Fprintln(os.Stderr, "error: unknown tag '" + name + "'")
         os.Exit(1)
     }
 
-    tagBytes, err := ioutil.ReadFile(filepath.Join(root, ".lvc/tags/", name))
+    tagBytes, err := ioutil.ReadFile(tagPath(name))
     if err != nil {
         panic(err)
     }
@@ -630,27 +1379,243 @@ func getTagID(name string) ID {
 }
 
 
+// Returns the id of the commit the tag points to
+func getTagID(name string) ID {
+    id := getTagRefID(name)
+    if tagObjectExists(id) {
+        return getTagObject(id).target
+    }
+    return id
+}
+
+
+func getTag(name string) Tag {
+    tag := Tag{
+        name: name,
+        id: getTagRefID(name),
+    }
+    if tagObjectExists(tag.id) {
+        tag.annotation = tag.id
+        tag.id = getTagObject(tag.annotation).target
+    }
+    return tag
+}
+
+
 func getAllTags() []Tag {
     tags := make([]Tag, 0)
 
     root, _ := findLvcRoot()
 
-    fileinfos, err := ioutil.ReadDir(filepath.Join(root, ".lvc/tags"))
-    for _, fi := range fileinfos {
-        name := fi.Name()
-        tags = append(tags, Tag{
-            name: name,
-            id: getTagID(name),
-        })
+    for _, name := range listRefNames(filepath.Join(root, ".lvc/tags")) {
+        tags = append(tags, getTag(name))
+    }
+
+    return tags
+}
+
+
+var errUnknownRevision = errors.New("unknown revision")
+
+// Resolves a revision to a commit id. A revision is HEAD, a branch, a tag,
+// a full commit id, an unambiguous prefix of one or a reflog entry like
+// master@{2}, optionally followed by any number of '~<n>' or '^' to walk
+// back through the parents.
+func resolveRevision(rev string) (ID, error) {
+    base := rev
+    back := 0
+    for {
+        if strings.HasSuffix(base, "^") {
+            base = base[:len(base)-1]
+            back++
+            continue
+        }
+
+        tilde := strings.LastIndex(base, "~")
+        if tilde == -1 {
+            break
+        }
+        n := 1
+        if digits := base[tilde+1:]; digits != "" {
+            if _, err := fmt.Sscanf(digits, "%d", &n); err != nil || fmt.Sprint(n) != digits {
+                break
+            }
+        }
+        base = base[:tilde]
+        back += n
+    }
+
+    id, err := resolveRevisionBase(base)
+    if err != nil {
+        return zeroID, err
+    }
+
+    for ; back > 0; back-- {
+        commit := getCommitWithoutFiles(id)
+        if commit.parent == zeroID {
+            return zeroID, fmt.Errorf("revision '%s' goes past the first commit", rev)
+        }
+        id = commit.parent
+    }
+
+    return id, nil
+}
+
+
+func resolveRevisionBase(rev string) (ID, error) {
+    if rev == "HEAD" {
+        return getHeadID(), nil
     }
+
+    if strings.Contains(rev, "@{") && strings.HasSuffix(rev, "}") {
+        return resolveReflogRevision(rev)
+    }
+
+    if validateRefName(rev) == nil {
+        if refExists(branchPath(rev)) {
+            return getBranchID(rev), nil
+        }
+        if refExists(tagPath(rev)) {
+            return getTagID(rev), nil
+        }
+    }
+
+    if len(rev) < 4 {
+        return zeroID, fmt.Errorf("%w '%s'", errUnknownRevision, rev)
+    }
+    if strings.Trim(rev, "0123456789abcdefABCDEF") != "" {
+        return zeroID, fmt.Errorf("%w '%s'", errUnknownRevision, rev)
+    }
+
+    root, _ := findLvcRoot()
+    fileinfos, err := ioutil.ReadDir(filepath.Join(root, ".lvc/commits"))
     if err != nil {
         panic(err)
     }
-    
+
+    matches := make([]string, 0)
+    for _, fi := range fileinfos {
+        if strings.HasPrefix(fi.Name(), strings.ToLower(rev)) {
+            matches = append(matches, fi.Name())
+        }
+    }
+
+    if len(matches) == 0 {
+        return zeroID, fmt.Errorf("%w '%s'", errUnknownRevision, rev)
+    } else if len(matches) > 1 {
+        return zeroID, fmt.Errorf("ambiguous revision '%s', it matches %d commits", rev, len(matches))
+    }
+
+    idBytes, _ := hex.DecodeString(matches[0])
+    id := ID{}
+    copy(id[:], idBytes)
+
+    return id, nil
+}
+
+
+func resolveRevisionOrExit(rev string) ID {
+    id, err := resolveRevision(rev)
+    if err != nil {
+        fmt.Fprintln(os.Stderr, "error: " + err.Error())
+        os.Exit(1)
+    }
+    return id
+}
+
+
+// Returns the parents of the commit. Commits only have a single parent for
+// now, merge commits would add their second parent here.
+func commitParents(commit Commit) []ID {
+    if commit.parent == zeroID {
+        return []ID{}
+    }
+    return []ID{commit.parent}
+}
+
+
+// Returns the ids of all commits reachable from a branch or tag that have id
+// as a parent. Commits left behind by amend, reset, rebase or undo are not
+// reachable and are not counted.
+func getChildCommits(id ID) []ID {
+    tips := make([]ID, 0)
+    for _, b := range getAllBranches() {
+        tips = append(tips, b.id)
+    }
+    for _, t := range getAllTags() {
+        tips = append(tips, t.id)
+    }
+    if isHeadDetached() {
+        tips = append(tips, getHeadID())
+    }
+
+    visited := make(map[ID]bool)
+    children := make([]ID, 0)
+    for len(tips) > 0 {
+        current := tips[len(tips)-1]
+        tips = tips[:len(tips)-1]
+        if current == zeroID || visited[current] {
+            continue
+        }
+        visited[current] = true
+
+        parents := commitParents(getCommitWithoutFiles(current))
+        for _, parent := range parents {
+            if parent == id {
+                children = append(children, current)
+                break
+            }
+        }
+        tips = append(tips, parents...)
+    }
+
+    return children
+}
+
+
+// Returns all tags pointing at the commit id
+func getTagsAt(id ID) []Tag {
+    tags := make([]Tag, 0)
+    for _, t := range getAllTags() {
+        if t.id == id {
+            tags = append(tags, t)
+        }
+    }
     return tags
 }
 
 
+// Returns the newest commit that both a and b descend from
+func findMergeBase(a ID, b ID) (ID, bool) {
+    ancestors := make(map[ID]bool)
+    for id := a; id != zeroID; id = getCommitWithoutFiles(id).parent {
+        ancestors[id] = true
+    }
+
+    for id := b; id != zeroID; id = getCommitWithoutFiles(id).parent {
+        if ancestors[id] {
+            return id, true
+        }
+    }
+
+    return zeroID, false
+}
+
+
+// Returns the commits after base up to and including tip, oldest first
+func commitsBetween(base ID, tip ID) []ID {
+    ids := make([]ID, 0)
+    for id := tip; id != base && id != zeroID; id = getCommitWithoutFiles(id).parent {
+        ids = append(ids, id)
+    }
+
+    for i, j := 0, len(ids)-1; i < j; i, j = i+1, j-1 {
+        ids[i], ids[j] = ids[j], ids[i]
+    }
+    return ids
+}
+
+
 func getFirstCommit(startCommit ID) Commit {
     commit := getCommit(startCommit)
     for commit.parent != zeroID {
@@ -673,16 +1638,34 @@ func countCommitsInBranch(branch string) int {
 }
 
 
+func idFromHex(text string) (ID, error) {
+    id := ID{}
+    idBytes, err := hex.DecodeString(text)
+    if err != nil {
+        return id, err
+    }
+    if len(idBytes) != len(id) {
+        return id, errors.New("'" + text + "' is not a valid id")
+    }
+    copy(id[:], idBytes)
+    return id, nil
+}
+
+
 func idsAreEqual(a ID, b ID) bool {
     return bytes.Equal(a[:], b[:])
 }
 
 
-func setHead(branch string) {
+// Checks out branch, reason is logged in the HEAD reflog
+func setHead(branch string, reason string) {
+    old := getHeadID()
     // This will check if the branch exists
-    getBranch(branch)
+    id := getBranchID(branch)
     root, _ := findLvcRoot()
     ioutil.WriteFile(filepath.Join(root, ".lvc/head"), []byte(branch + "\n"), 0644)
+
+    appendReflog("HEAD", old, id, reason)
 }
 
 
@@ -704,7 +1687,7 @@ func checkoutBranch(name string) {
 
         if !idsAreEqual(f.id, currentID) {
             if !yesno(fmt.Sprintf("Contents of file '%s' has changed since last commit, checking out this branch will OVERWRITE it, Are you sure you want to proceed?", f.name), false) {
-                fmt.Println("Stopping checkout due to user input.")
+                fmt.Println("Stopping checkout due to user input, use 'lvc stash' to save your changes first.")
                 os.Exit(0)
             }
         }
@@ -743,99 +1726,7 @@ func checkoutBranch(name string) {
     }
 
     // set head to current branch
-    setHead(name)
-}
-
-
-func diffWorkingWith(id ID) {
-    root, err := findLvcRoot()
-    if err != nil {
-        panic(err)
-    }
-
-    commit := getCommit(id)
-
-    //TODO: Handle files that are present in the commit, but missing in working
-    dmp := diffmatchpatch.New()
-
-    cmd, pagerIn := startPager()
-    
-    filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
-        if info.IsDir() && info.Name() == ".lvc" {
-            return filepath.SkipDir
-        }
-        abs := path
-        path, _ = filepath.Rel(root, path)
-
-        for _, cf := range commit.files {
-            if pathsAreEqual(path, cf.name) {
-                // files is tracked
-                id := getFileHash(abs)
-                if !idsAreEqual(id, cf.id) {
-                    // start := time.Now()
-                    
-                    if(true) {
-                        workingFile, _ := ioutil.ReadFile(abs)
-                        commitFile, _ := ioutil.ReadFile(filepath.Join(root, "/.lvc/blobs/", hex.EncodeToString(cf.id[:])))
-
-                        a, b, arr := dmp.DiffLinesToChars(string(commitFile), string(workingFile))
-                        diff := dmp.DiffMain(a, b, false)
-                        diff = dmp.DiffCharsToLines(diff, arr)
-                        //diff = dmp.DiffCleanupSemantic(diff)
-                        
-                        // Show only the 4 first and last lines of and equals
-                        // if its longer than 8 or so lines maybe
-                        totalInserts := 0
-                        totalDeletions := 0
-
-                        for _, d := range diff {
-                            switch d.Type {
-                            case diffmatchpatch.DiffInsert:
-                                totalInserts += countLines(d.Text)
-                            case diffmatchpatch.DiffDelete:
-                                totalDeletions += countLines(d.Text)
-                            }
-                        }
-
-                        fmt.Fprintf(pagerIn, "%s - %d inserts(+), %d deletions(-)\n", path, totalInserts, totalDeletions)
-
-                        offset := 0
-                        for i, d := range diff {
-                            switch d.Type {
-                            case diffmatchpatch.DiffEqual:
-                                first, _ := getFirstLines(d.Text, 3)
-                                last, _ := getLastLines(d.Text, 3)
-                                
-                                if i-1 >= 0 {
-                                    printTextWithPrefixSuffix(pagerIn, first, " ", "")
-                                }
-                                // TODO: This isnt quite right, but usable for now
-                                line, _ := getLineAndOffsetInString(string(commitFile), offset+len(d.Text))
-                                fmt.Fprintf(pagerIn, "@ %s - %d\n", path, line)
-                                printTextWithPrefixSuffix(pagerIn, last, " ", "")
-                            case diffmatchpatch.DiffInsert:
-                                printTextWithPrefixSuffix(pagerIn, d.Text, "\033[32m+", "\033[0m")
-                            case diffmatchpatch.DiffDelete:
-                                printTextWithPrefixSuffix(pagerIn, d.Text, "\033[31m-", "\033[0m")
-                            }
-                            offset += len(d.Text)
-                        }
-
-                        fmt.Fprintln(pagerIn)
-                    } else {
-                        cmd := exec.Command("diff", "-u", filepath.Join(root, "/.lvc/blobs/", hex.EncodeToString(cf.id[:]), path))
-                        cmd.Stdout = os.Stdout
-                        cmd.Run()
-                    }
-
-                }
-            }
-        }
-                
-        return nil
-    })
-
-    endPager(cmd, pagerIn)
+    setHead(name, "checkout: moving from " + readHeadFile() + " to " + name)
 }
 
 
@@ -849,6 +1740,7 @@ func initialize() {
     createDirectory(".lvc/blobs")
     createDirectory(".lvc/branches")
     createDirectory(".lvc/tags")
+    createDirectory(".lvc/tagobjects")
 
 
     // create the baseline commit
@@ -862,6 +1754,9 @@ func initialize() {
     // point head to master
     ioutil.WriteFile(".lvc/head", []byte("master\n"), 0644)
 
+    appendReflog("master", zeroID, commitID, "init")
+    appendReflog("HEAD", zeroID, commitID, "init")
+
     stage, err := os.Create(".lvc/stage")
     if err != nil {
         fmt.Fprintln(os.Stderr, "error: failed to create .lvc/head")
@@ -876,80 +1771,42 @@ func initialize() {
 }
 
 
-func commitStage(msg string, author string, ) {
-    commit := make([]CommitFile, 0)
-
-    root, _ := findLvcRoot()
-
+// Commits the stage on top of HEAD, info holds the message, author and committer.
+// When amending, HEAD is replaced by a commit with HEAD's parent instead.
+func commitStage(info Commit, amend bool) {
     head := getHead()
-    stageFiles := readStageFile()
-
-    headFilesLoop:
-    for _, hf := range head.files {
-        for _, sf := range stageFiles {
-            if pathsAreEqual(sf, hf.name) {
-                continue headFilesLoop
-            }
-        }
-        commit = append(commit, hf)
-    }
+    entries := readStage()
 
     filesChanged := 0
     filesCreated := 0
 
-    stageFileLoop:
-    for _, f := range stageFiles {
-        // If file is new, commit anyways
-        // If the files is not new, checked if the hash differ, if so commit it
-        for _, hf := range head.files {
-            if pathsAreEqual(hf.name, f) {
-                // File is not new
-                hash := getFileHash(filepath.Join(root, f))
-                
-                if bytes.Equal(hash[:], hf.id[:]) {
-                    commit = append(commit, hf)
-                } else {
-                    commit = append(commit, CommitFile{
-                        name: f,
-                        id: hash,
-                    })
-                    createBlobForFileWithID(f, hash)
-                    filesChanged++
-                }
-
-                continue stageFileLoop
+    for _, e := range entries {
+        hf, ok := findCommitFile(head.files, e.name)
+        if !ok {
+            if e.id != zeroID {
+                filesCreated++
             }
+        } else if hf.id != e.id {
+            filesChanged++
         }
-
-        id := getFileHash(filepath.Join(root, f))
-        commit = append(commit, CommitFile{
-            name: f,
-            id: id,
-        })
-        createBlobForFileWithID(filepath.Join(root, f), id)
-        filesCreated++
     }
 
-    headid := getHeadID()
+    commit := applyStage(head.files, entries)
 
-    builder := strings.Builder{}
-    builder.WriteString(hex.EncodeToString(headid[:]) + "\n")
-    builder.WriteString(msg + "\n")
-    builder.WriteString(author + "\n")
-    builder.WriteString(time.Now().Format(time.RFC3339) + "\n")
-    for _, c := range commit {
-        builder.WriteString(hex.EncodeToString(c.id[:]) + " " + c.name + "\n")
+    info.parent = head.id
+    if amend {
+        info.parent = head.parent
     }
-
-    final := builder.String()
-    id := ID(sha256.Sum256([]byte(final)))
-
-    // write commit to file
-    ioutil.WriteFile(filepath.Join(".lvc/commits/", hex.EncodeToString(id[:])), []byte(final), 0644)
+    info.files = commit
+    id := writeCommit(info)
 
     clearStage()
 
-    updateHead(id)
+    reason := "commit: " + messageSubject(info.message)
+    if amend {
+        reason = "commit (amend): " + messageSubject(info.message)
+    }
+    updateHead(id, reason)
 
     fmt.Printf("%s\n%d file(s) changes. %d file(s) created\n", hex.EncodeToString(id[:]), filesChanged, filesCreated)
 }
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+
+// Creates a repository in a temporary directory and makes it the current
+// one, the returned function removes it again
+func newTestRepo(t *testing.T) (string, func()) {
+    dir, err := ioutil.TempDir("", "lvc-test")
+    if err != nil {
+        t.Fatal(err)
+    }
+    wd, err := os.Getwd()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := os.Chdir(dir); err != nil {
+        t.Fatal(err)
+    }
+
+    initialize()
+    _lvcRoot = dir
+    _config = nil
+
+    return dir, func() {
+        _lvcRoot = ""
+        _config = nil
+        os.Chdir(wd)
+        os.RemoveAll(dir)
+    }
+}
+
+
+// Writes and stages a file, then commits it
+func commitTestFile(t *testing.T, root string, name string, text string) ID {
+    path := filepath.Join(root, name)
+    if err := writeFile(path, text); err != nil {
+        t.Fatal(err)
+    }
+    entries := setStageEntry(readStage(), StageEntry{
+        name: name,
+        id: createBlob([]byte(text)),
+    })
+    writeStage(entries)
+
+    commitStage(newCommitInfo("change " + name), false)
+    return getHeadID()
+}
+
+
+func TestValidateRefName(t *testing.T) {
+    valid := []string{"master", "feature/login", "v1.0", "release-2", "HEADS", "my-HEAD"}
+    invalid := []string{
+        "", "-x", "a..b", "a.lock", "a@{1}", "a b", "a~1", "a^", "a:b", "a?", "a*", "a[",
+        "a//b", "/a", "a/", ".a", "a.", "a/.b",
+        "HEAD",
+    }
+
+    for _, name := range valid {
+        if err := validateRefName(name); err != nil {
+            t.Errorf("validateRefName(%q) failed: %v", name, err)
+        }
+    }
+    for _, name := range invalid {
+        if validateRefName(name) == nil {
+            t.Errorf("validateRefName(%q) accepted an invalid name", name)
+        }
+    }
+}
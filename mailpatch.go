@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+
+// format-patch writes one file per commit in the mbox format:
+//  From <commitid> Mon Sep 17 00:00:00 2001
+//  From: <author>
+//  Date: <author date, RFC 1123 with numeric zone>
+//  Subject: [PATCH <n>/<total>] <subject>
+//
+//  <rest of the message>
+//  ---
+//  <unified diff of the commit>
+//
+// 'lvc am' reads the same format back, the "[PATCH ...]" prefix is dropped from the subject.
+
+// The date on the "From" line is fixed, like git does, so tools can recognize the format
+const mboxFromDate = "Mon Sep 17 00:00:00 2001"
+
+
+// A commit read from a patch file
+type MailPatch struct {
+    author    string
+    timestamp time.Time
+    message   string
+    diff      string
+}
+
+
+func encodeMailPatch(commit Commit, number int, total int) string {
+    builder := strings.Builder{}
+    builder.WriteString("From " + hex.EncodeToString(commit.id[:]) + " " + mboxFromDate + "\n")
+    builder.WriteString("From: " + commit.author + "\n")
+    builder.WriteString("Date: " + commit.timestamp.Format(time.RFC1123Z) + "\n")
+    builder.WriteString(fmt.Sprintf("Subject: [PATCH %d/%d] %s\n", number, total, messageSubject(commit.message)))
+    builder.WriteString("\n")
+
+    body := strings.TrimLeft(strings.TrimPrefix(commit.message, messageSubject(commit.message)), "\r\n")
+    if body != "" {
+        builder.WriteString(withTrailingNewline(body) + "\n")
+    }
+    builder.WriteString("---\n")
+
+    from := diffSide{files: getCommitFiles(commit.parent)}
+    to := diffSide{files: getCommit(commit.id).files}
+    diffTrees(&builder, from, to, false)
+
+    return builder.String()
+}
+
+
+// Returns the file name for a patch, ex. "0001-Fix-the-thing.patch"
+func mailPatchFileName(number int, subject string) string {
+    slug := strings.Builder{}
+    dash := false
+    for _, c := range subject {
+        if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '_' || c == '.' {
+            if dash && slug.Len() > 0 {
+                slug.WriteByte('-')
+            }
+            slug.WriteRune(c)
+            dash = false
+        } else {
+            dash = true
+        }
+        if slug.Len() >= 52 {
+            break
+        }
+    }
+
+    name := strings.Trim(slug.String(), ".")
+    return fmt.Sprintf("%04d-%s.patch", number, name)
+}
+
+
+func parseMailPatch(text string) (MailPatch, error) {
+    lines := strings.SplitAfter(text, "\n")
+    patch := MailPatch{}
+    subject := ""
+
+    i := 0
+    if i < len(lines) && strings.HasPrefix(lines[i], "From ") {
+        i++
+    }
+
+    // Headers, a line starting with whitespace continues the previous header
+    lastHeader := ""
+    for ; i < len(lines); i++ {
+        line := strings.TrimRight(lines[i], "\r\n")
+        if line == "" {
+            i++
+            break
+        }
+
+        if (line[0] == ' ' || line[0] == '\t') && lastHeader == "Subject" {
+            subject += " " + strings.TrimSpace(line)
+            continue
+        }
+
+        kv := strings.SplitN(line, ":", 2)
+        if len(kv) != 2 {
+            return patch, errors.New("invalid header line '" + line + "'")
+        }
+        lastHeader = kv[0]
+        value := strings.TrimSpace(kv[1])
+
+        switch kv[0] {
+        case "From":
+            patch.author = value
+        case "Date":
+            t, err := time.Parse(time.RFC1123Z, value)
+            if err != nil {
+                return patch, errors.New("invalid date '" + value + "'")
+            }
+            patch.timestamp = t
+        case "Subject":
+            subject = value
+        }
+    }
+
+    if patch.author == "" || subject == "" {
+        return patch, errors.New("the patch has no author or subject")
+    }
+    if patch.timestamp.IsZero() {
+        return patch, errors.New("the patch has no date")
+    }
+
+    // Drop the "[PATCH 1/2]" prefix
+    if strings.HasPrefix(subject, "[") {
+        if end := strings.Index(subject, "]"); end != -1 {
+            subject = strings.TrimSpace(subject[end+1:])
+        }
+    }
+
+    body := strings.Builder{}
+    for ; i < len(lines); i++ {
+        if strings.TrimRight(lines[i], "\r\n") == "---" {
+            i++
+            break
+        }
+        body.WriteString(lines[i])
+    }
+
+    patch.message = subject
+    if text := strings.TrimSpace(body.String()); text != "" {
+        patch.message += "\n\n" + text
+    }
+    patch.diff = strings.Join(lines[i:], "")
+
+    return patch, nil
+}
+
+
+// Applies the patch to the working tree and stage and commits it with the
+// author, date and message of the patch. Returns an error without changing
+// anything if the patch does not apply.
+func commitMailPatch(patch MailPatch) error {
+    if err := validateIdentity(patch.author); err != nil {
+        return errors.New("invalid author: " + err.Error())
+    }
+
+    patches, err := parsePatch(patch.diff)
+    if err != nil {
+        return err
+    }
+
+    results, err := applyFilePatches(patches)
+    if err != nil {
+        return err
+    }
+    for _, r := range results {
+        if len(r.rejected) > 0 {
+            return fmt.Errorf("hunk %s of %s does not apply", r.rejected[0].header, patchName(r.patch))
+        }
+    }
+
+    writePatchResults(results, true)
+
+    info := newCommitInfo(patch.message)
+    info.author = patch.author
+    info.timestamp = patch.timestamp
+    commitStage(info, false)
+    return nil
+}
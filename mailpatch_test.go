@@ -0,0 +1,48 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+
+const testMailPatchHeader = "From 0000000000000000000000000000000000000000000000000000000000000000 Mon Sep 17 00:00:00 2001\n" +
+                            "From: thebirk <totally@fake.mail>\n" +
+                            "Date: Sat, 01 Feb 2020 12:00:00 +0100\n" +
+                            "Subject: [PATCH 1/1] Plant a key\n" +
+                            "\n" +
+                            "---\n"
+
+
+func TestAmRefusesLvcDir(t *testing.T) {
+    text := testMailPatchHeader +
+            "diff --git a/.lvc/trusted_keys b/.lvc/trusted_keys\n" +
+            "--- a/.lvc/trusted_keys\n" +
+            "+++ b/.lvc/trusted_keys\n" +
+            "@@ -0,0 +1 @@\n" +
+            "+key thebirk\n"
+
+    patch, err := parseMailPatch(text)
+    if err != nil {
+        t.Fatalf("parseMailPatch failed: %v", err)
+    }
+    // The patch is refused before the working tree or stage is touched
+    if err := commitMailPatch(patch); err == nil || !strings.Contains(err.Error(), ".lvc") {
+        t.Errorf("commitMailPatch accepted a patch for .lvc, err = %v", err)
+    }
+}
+
+
+func TestParseMailPatchRequiresDate(t *testing.T) {
+    body := "Subject: [PATCH 1/1] Change\n" +
+            "\n" +
+            "---\n" +
+            "--- a/f\n+++ b/f\n@@ -1 +1 @@\n-a\n+b\n"
+
+    for _, date := range []string{"", "Date: yesterday\n"} {
+        text := "From: thebirk <totally@fake.mail>\n" + date + body
+        if patch, err := parseMailPatch(text); err == nil {
+            t.Errorf("parseMailPatch accepted the date %q as %v", date, patch.timestamp)
+        }
+    }
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"strings"
+)
+
+
+// A hunk replaces the lines [start, end) of the base with lines
+type hunk struct {
+    start int
+    end   int
+    lines []string
+}
+
+
+// Splits text into lines, each line keeps its newline
+func splitLines(text string) []string {
+    lines := strings.SplitAfter(text, "\n")
+    if len(lines) > 0 && lines[len(lines)-1] == "" {
+        lines = lines[:len(lines)-1]
+    }
+    return lines
+}
+
+
+// Returns the hunks that turn base into other, using the selected diff algorithm
+func diffHunks(base string, other string) []hunk {
+    return diffLines(selectedDiffAlgorithm(), splitLines(base), splitLines(other))
+}
+
+
+// Applies hunks, which must lie within [lo, hi), to those lines of base
+func applyHunks(base []string, lo int, hi int, hunks []hunk) []string {
+    result := make([]string, 0)
+    pos := lo
+    for _, h := range hunks {
+        result = append(result, base[pos:h.start]...)
+        result = append(result, h.lines...)
+        pos = h.end
+    }
+    return append(result, base[pos:hi]...)
+}
+
+
+// Three-way merges the changes from base to ours and from base to theirs.
+// Changes touching the same lines are conflicts and are written with
+// conflict markers. Returns the merged text and whether it is conflict free.
+func mergeText(base string, ours string, theirs string, oursLabel string, theirsLabel string) (string, bool) {
+    baseLines := splitLines(base)
+    oursHunks := diffHunks(base, ours)
+    theirsHunks := diffHunks(base, theirs)
+
+    result := strings.Builder{}
+    clean := true
+    pos := 0
+    i, j := 0, 0
+
+    for i < len(oursHunks) || j < len(theirsHunks) {
+        // Start a group with the hunk that comes first, then pull in every hunk
+        // from either side that overlaps or touches the group
+        var lo, hi int
+        if j >= len(theirsHunks) || (i < len(oursHunks) && oursHunks[i].start <= theirsHunks[j].start) {
+            lo, hi = oursHunks[i].start, oursHunks[i].end
+        } else {
+            lo, hi = theirsHunks[j].start, theirsHunks[j].end
+        }
+
+        oursGroup := make([]hunk, 0)
+        theirsGroup := make([]hunk, 0)
+        for {
+            if i < len(oursHunks) && oursHunks[i].start <= hi {
+                if oursHunks[i].end > hi {
+                    hi = oursHunks[i].end
+                }
+                oursGroup = append(oursGroup, oursHunks[i])
+                i++
+            } else if j < len(theirsHunks) && theirsHunks[j].start <= hi {
+                if theirsHunks[j].end > hi {
+                    hi = theirsHunks[j].end
+                }
+                theirsGroup = append(theirsGroup, theirsHunks[j])
+                j++
+            } else {
+                break
+            }
+        }
+
+        result.WriteString(strings.Join(baseLines[pos:lo], ""))
+        pos = hi
+
+        oursText := strings.Join(applyHunks(baseLines, lo, hi, oursGroup), "")
+        theirsText := strings.Join(applyHunks(baseLines, lo, hi, theirsGroup), "")
+
+        if len(theirsGroup) == 0 || oursText == theirsText {
+            result.WriteString(oursText)
+        } else if len(oursGroup) == 0 {
+            result.WriteString(theirsText)
+        } else {
+            clean = false
+            result.WriteString("<<<<<<< " + oursLabel + "\n")
+            result.WriteString(withTrailingNewline(oursText))
+            result.WriteString("=======\n")
+            result.WriteString(withTrailingNewline(theirsText))
+            result.WriteString(">>>>>>> " + theirsLabel + "\n")
+        }
+    }
+
+    result.WriteString(strings.Join(baseLines[pos:], ""))
+
+    return result.String(), clean
+}
+
+
+func withTrailingNewline(text string) string {
+    if text != "" && !strings.HasSuffix(text, "\n") {
+        return text + "\n"
+    }
+    return text
+}
+
+
+// Three-way merges the files of two trees with a common base. Conflicted files
+// are included in the result with conflict markers, as the modified version
+// when one side removed the file, or as our version when the file is binary.
+// Returns the merged files and the conflicted paths.
+func mergeTrees(base []CommitFile, ours []CommitFile, theirs []CommitFile, oursLabel string, theirsLabel string) ([]CommitFile, []string) {
+    merged := make([]CommitFile, 0)
+    conflicts := make([]string, 0)
+
+    // Every path in any of the trees, in order of first appearance
+    names := make([]string, 0)
+    for _, files := range [][]CommitFile{ours, theirs, base} {
+        for _, f := range files {
+            found := false
+            for _, n := range names {
+                if pathsAreEqual(n, f.name) {
+                    found = true
+                    break
+                }
+            }
+            if !found {
+                names = append(names, f.name)
+            }
+        }
+    }
+
+    for _, name := range names {
+        b, _ := findCommitFile(base, name)
+        o, _ := findCommitFile(ours, name)
+        t, _ := findCommitFile(theirs, name)
+
+        var result ID
+        switch {
+        case o.id == t.id:
+            result = o.id
+        case b.id == o.id:
+            result = t.id
+        case b.id == t.id:
+            result = o.id
+        case o.id == zeroID:
+            // Removed in ours and modified in theirs, keep the modified version
+            result = t.id
+            conflicts = append(conflicts, name)
+        case t.id == zeroID:
+            result = o.id
+            conflicts = append(conflicts, name)
+        default:
+            oursData := readBlob(o.id)
+            theirsData := readBlob(t.id)
+            if isBinary(name, oursData) || isBinary(name, theirsData) {
+                // Binary files cannot be merged by line, keep ours as a whole
+                result = o.id
+                conflicts = append(conflicts, name)
+                break
+            }
+
+            baseText := ""
+            if b.id != zeroID {
+                baseText = string(readBlob(b.id))
+            }
+            text, clean := mergeText(baseText, string(oursData), string(theirsData), oursLabel, theirsLabel)
+            result = createBlob([]byte(text))
+            if !clean {
+                conflicts = append(conflicts, name)
+            }
+        }
+
+        if result != zeroID {
+            merged = append(merged, CommitFile{
+                name: name,
+                id: result,
+            })
+        }
+    }
+
+    return merged, conflicts
+}
+
+
+// Writes the result of mergeTrees to the working tree and stages everything
+// except the conflicts, which have to be resolved and staged by the user
+func applyMergeResult(current []CommitFile, merged []CommitFile, conflicts []string) {
+    updateWorkingTree(current, merged)
+
+    entries := make([]StageEntry, 0)
+    for _, e := range stageEntriesBetween(current, merged) {
+        conflicted := false
+        for _, c := range conflicts {
+            if pathsAreEqual(c, e.name) {
+                conflicted = true
+                break
+            }
+        }
+        if !conflicted {
+            entries = append(entries, e)
+        }
+    }
+    writeStage(entries)
+}
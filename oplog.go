@@ -0,0 +1,363 @@
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+
+// Before every command that changes refs, HEAD, the stage or the stash the
+// state of the repository is saved in .lvc/operations/<n>, where n counts up
+// from 1:
+//  command <command line>
+//  date <timestamp>
+//  identity <user.author>
+//  head <branch or commit id>
+//  branch <commitid> <name> ; one per branch
+//  tag <id> <name>          ; one per tag, the id is the tag object of annotated tags
+//  stage <blobid> <name>    ; one per stage entry
+//  stash <commitid>         ; one per stash entry, newest first
+//
+// 'lvc undo' puts the refs, HEAD, stage and stash back to the newest saved
+// state and forgets it, so undoing again goes further back. Commands that end
+// up changing nothing are forgotten when the next command is saved.
+
+
+// Commands that save the state before running
+var operationCommands = map[string]bool{
+    "add":         true,
+    "restore":     true,
+    "apply":       true,
+    "commit":      true,
+    "checkout":    true,
+    "branch":      true,
+    "tag":         true,
+    "reset":       true,
+    "revert":      true,
+    "cherry-pick": true,
+    "rebase":      true,
+    "stash":       true,
+    "am":          true,
+}
+
+
+// Returns true if command with the parsed arguments can change the state
+func isOperation(command string) bool {
+    if !operationCommands[command] {
+        return false
+    }
+
+    switch command {
+    case "branch":
+        return flag.NArg() > 0
+    case "stash":
+        return flag.NArg() == 0 || (flag.Arg(0) != "list" && flag.Arg(0) != "show")
+    // These only change the saved state when they write the stage
+    case "restore":
+        return *flagStaged
+    case "apply":
+        return *flagStage && !*flagCheck
+    }
+    return true
+}
+
+
+type Operation struct {
+    number    int
+    command   string
+    timestamp time.Time
+    identity  string
+    head      string
+    branches  []Branch
+    tags      []Tag
+    stage     []StageEntry
+    stash     []ID
+}
+
+
+func operationPath(number int) string {
+    root, _ := findLvcRoot()
+    return filepath.Join(root, ".lvc/operations", strconv.Itoa(number))
+}
+
+
+// Returns the numbers of all saved operations, oldest first
+func listOperations() []int {
+    root, _ := findLvcRoot()
+    fileinfos, err := ioutil.ReadDir(filepath.Join(root, ".lvc/operations"))
+    if err != nil {
+        return make([]int, 0)
+    }
+
+    numbers := make([]int, 0)
+    for _, fi := range fileinfos {
+        if n, err := strconv.Atoi(fi.Name()); err == nil {
+            numbers = append(numbers, n)
+        }
+    }
+    sort.Ints(numbers)
+    return numbers
+}
+
+
+// Returns the current refs, HEAD, stage and stash
+func currentOperationState() Operation {
+    root, _ := findLvcRoot()
+
+    op := Operation{
+        head: readHeadFile(),
+        branches: getAllBranches(),
+        tags: make([]Tag, 0),
+        stage: readStage(),
+        stash: readStashIDs(),
+    }
+    for _, name := range listRefNames(filepath.Join(root, ".lvc/tags")) {
+        op.tags = append(op.tags, Tag{
+            name: name,
+            id: getTagRefID(name),
+        })
+    }
+    return op
+}
+
+
+// Encodes everything but the command, date and identity
+func encodeOperationState(op Operation) string {
+    builder := strings.Builder{}
+    builder.WriteString("head " + op.head + "\n")
+    for _, b := range op.branches {
+        builder.WriteString("branch " + hex.EncodeToString(b.id[:]) + " " + b.name + "\n")
+    }
+    for _, t := range op.tags {
+        builder.WriteString("tag " + hex.EncodeToString(t.id[:]) + " " + t.name + "\n")
+    }
+    for _, e := range op.stage {
+        builder.WriteString("stage " + hex.EncodeToString(e.id[:]) + " " + e.name + "\n")
+    }
+    for _, id := range op.stash {
+        builder.WriteString("stash " + hex.EncodeToString(id[:]) + "\n")
+    }
+    return builder.String()
+}
+
+
+func encodeOperation(op Operation) string {
+    builder := strings.Builder{}
+    builder.WriteString("command " + op.command + "\n")
+    builder.WriteString("date " + op.timestamp.Format(time.RFC3339) + "\n")
+    builder.WriteString("identity " + op.identity + "\n")
+    builder.WriteString(encodeOperationState(op))
+    return builder.String()
+}
+
+
+func readOperation(number int) Operation {
+    data, err := ioutil.ReadFile(operationPath(number))
+    if err != nil {
+        panic(err)
+    }
+
+    op := Operation{
+        number: number,
+        branches: make([]Branch, 0),
+        tags: make([]Tag, 0),
+        stage: make([]StageEntry, 0),
+        stash: make([]ID, 0),
+    }
+
+    for _, line := range strings.Split(string(data), "\n") {
+        kv := strings.SplitN(line, " ", 2)
+        if len(kv) != 2 {
+            continue
+        }
+
+        switch kv[0] {
+        case "command":
+            op.command = kv[1]
+        case "date":
+            op.timestamp, _ = time.Parse(time.RFC3339, kv[1])
+        case "identity":
+            op.identity = kv[1]
+        case "head":
+            op.head = kv[1]
+        case "stash":
+            id, err := idFromHex(kv[1])
+            if err != nil {
+                panic("invalid line in operation " + strconv.Itoa(number) + " '" + line + "'")
+            }
+            op.stash = append(op.stash, id)
+        case "branch", "tag", "stage":
+            fields := strings.SplitN(kv[1], " ", 2)
+            id, err := idFromHex(fields[0])
+            if err != nil || len(fields) != 2 {
+                panic("invalid line in operation " + strconv.Itoa(number) + " '" + line + "'")
+            }
+
+            if kv[0] == "branch" {
+                op.branches = append(op.branches, Branch{name: fields[1], id: id})
+            } else if kv[0] == "tag" {
+                op.tags = append(op.tags, Tag{name: fields[1], id: id})
+            } else {
+                op.stage = append(op.stage, StageEntry{name: fields[1], id: id})
+            }
+        }
+    }
+
+    return op
+}
+
+
+// Saves the current state before running command. The previous operation is
+// dropped if it did not change anything.
+func recordOperation(command string) {
+    op := currentOperationState()
+    op.command = command
+    op.timestamp = time.Now()
+    op.identity = currentAuthor()
+
+    numbers := listOperations()
+    number := 1
+    if len(numbers) > 0 {
+        last := numbers[len(numbers)-1]
+        number = last + 1
+        if encodeOperationState(readOperation(last)) == encodeOperationState(op) {
+            if err := os.Remove(operationPath(last)); err != nil {
+                panic(err)
+            }
+            number = last
+        }
+    }
+
+    if err := os.MkdirAll(filepath.Dir(operationPath(number)), 0777); err != nil {
+        panic(err)
+    }
+    if err := writeFile(operationPath(number), encodeOperation(op)); err != nil {
+        panic(err)
+    }
+}
+
+
+// Puts the refs, HEAD, stage, stash and working tree back to the state saved
+// by the newest operation that changed anything and forgets it. Returns false
+// if there is nothing to undo.
+func undoOperation() (Operation, bool) {
+    current := currentOperationState()
+    numbers := listOperations()
+
+    for len(numbers) > 0 {
+        op := readOperation(numbers[len(numbers)-1])
+        numbers = numbers[:len(numbers)-1]
+        if err := os.Remove(operationPath(op.number)); err != nil {
+            panic(err)
+        }
+
+        if encodeOperationState(op) != encodeOperationState(current) {
+            restoreOperationState(current, op)
+            return op, true
+        }
+    }
+
+    return Operation{}, false
+}
+
+
+func restoreOperationState(current Operation, op Operation) {
+    root, _ := findLvcRoot()
+    reason := "undo: " + op.command
+    oldFiles := getStagedFiles()
+    oldHead := getHeadID()
+
+    for _, b := range current.branches {
+        if _, ok := findBranch(op.branches, b.name); !ok {
+            if err := removeFileAndEmptyDirs(filepath.Join(root, ".lvc/branches"), branchPath(b.name)); err != nil {
+                panic(err)
+            }
+            appendReflog(b.name, b.id, zeroID, reason)
+        }
+    }
+    for _, b := range op.branches {
+        if c, ok := findBranch(current.branches, b.name); !ok || c.id != b.id {
+            if err := writeRef(branchPath(b.name), b.id); err != nil {
+                panic(err)
+            }
+            appendReflog(b.name, c.id, b.id, reason)
+        }
+    }
+
+    for _, t := range current.tags {
+        if _, ok := findTag(op.tags, t.name); !ok {
+            deleteTag(t.name, reason)
+        }
+    }
+    for _, t := range op.tags {
+        if c, ok := findTag(current.tags, t.name); !ok || c.id != t.id {
+            if err := writeRef(tagPath(t.name), t.id); err != nil {
+                panic(err)
+            }
+            appendTagReflog(t.name, c.id, t.id, reason)
+        }
+    }
+
+    if err := writeFile(filepath.Join(root, ".lvc/head"), op.head + "\n"); err != nil {
+        panic(err)
+    }
+    newHead := getHeadID()
+    if newHead != oldHead {
+        appendReflog("HEAD", oldHead, newHead, reason)
+    }
+
+    writeStage(op.stage)
+    // Commands that only change the stage, like add, leave the working tree
+    // alone, so undoing them must not overwrite the changes in it
+    if newHead != oldHead {
+        updateWorkingTree(oldFiles, getStagedFiles())
+    }
+
+    writeStashIDs(op.stash)
+    // Undoing a push puts the stashed changes back in the working tree, which
+    // the push had reset to HEAD
+    if newHead == oldHead && len(current.stash) == len(op.stash) + 1 &&
+        idListsAreEqual(current.stash[1:], op.stash) {
+        updateWorkingTree(getHead().files, getCommitFiles(current.stash[0]))
+    }
+}
+
+
+func idListsAreEqual(a, b []ID) bool {
+    if len(a) != len(b) {
+        return false
+    }
+    for i := range a {
+        if a[i] != b[i] {
+            return false
+        }
+    }
+    return true
+}
+
+
+func findBranch(branches []Branch, name string) (Branch, bool) {
+    for _, b := range branches {
+        if b.name == name {
+            return b, true
+        }
+    }
+    return Branch{}, false
+}
+
+
+func findTag(tags []Tag, name string) (Tag, bool) {
+    for _, t := range tags {
+        if t.name == name {
+            return t, true
+        }
+    }
+    return Tag{}, false
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+
+func TestUndoStash(t *testing.T) {
+    root, cleanup := newTestRepo(t)
+    defer cleanup()
+
+    commitTestFile(t, root, "a.txt", "a\n")
+    if err := writeFile(filepath.Join(root, "a.txt"), "changed\n"); err != nil {
+        t.Fatal(err)
+    }
+
+    recordOperation("stash")
+    if !stashPush("") {
+        t.Fatal("stashPush saved nothing")
+    }
+    pushed := readStashIDs()
+
+    recordOperation("stash drop")
+    stashDrop(0)
+
+    // Undoing the drop brings the entry back
+    if _, ok := undoOperation(); !ok {
+        t.Fatal("nothing to undo after stash drop")
+    }
+    if !idListsAreEqual(readStashIDs(), pushed) {
+        t.Fatal("undoing stash drop did not restore the entry")
+    }
+
+    // Undoing the push removes the entry and brings the changes back
+    if _, ok := undoOperation(); !ok {
+        t.Fatal("nothing to undo after stash push")
+    }
+    if len(readStashIDs()) != 0 {
+        t.Error("undoing stash push kept the entry")
+    }
+    data, err := ioutil.ReadFile(filepath.Join(root, "a.txt"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if string(data) != "changed\n" {
+        t.Errorf("a.txt is %q after undoing stash push", data)
+    }
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+
+// Every update of a branch is logged in .lvc/logs/branches/<name>, of a tag
+// in .lvc/logs/tags/<name>, and every change of HEAD in .lvc/logs/HEAD, one
+// line per update:
+//  <old id> <new id> <timestamp> <identity>\t<reason>
+//
+// The old id of a created ref and the new id of a deleted ref are zero.
+//
+// Nothing is ever removed from a log, so commits that are no longer on any
+// branch, ex. the original commits of a rebase, can still be found.
+// The entries are referred to as <ref>@{n}, where n is 0 for the newest entry.
+
+
+type ReflogEntry struct {
+    old       ID
+    new       ID
+    timestamp time.Time
+    identity  string
+    reason    string
+}
+
+
+func reflogPath(ref string) string {
+    root, _ := findLvcRoot()
+    if ref == "HEAD" {
+        return filepath.Join(root, ".lvc/logs/HEAD")
+    }
+    return filepath.Join(root, ".lvc/logs/branches", filepath.FromSlash(ref))
+}
+
+
+func tagReflogPath(name string) string {
+    root, _ := findLvcRoot()
+    return filepath.Join(root, ".lvc/logs/tags", filepath.FromSlash(name))
+}
+
+
+// Appends an entry to the log of ref, which is either "HEAD" or a branch
+func appendReflog(ref string, old ID, new ID, reason string) {
+    appendReflogEntry(reflogPath(ref), old, new, reason)
+}
+
+
+func appendTagReflog(name string, old ID, new ID, reason string) {
+    appendReflogEntry(tagReflogPath(name), old, new, reason)
+}
+
+
+func appendReflogEntry(path string, old ID, new ID, reason string) {
+    if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+        panic(err)
+    }
+
+    f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+    if err != nil {
+        panic(err)
+    }
+    defer f.Close()
+
+    // The reason is a single line, the tab separates it from the identity
+    reason = strings.ReplaceAll(messageSubject(reason), "\t", " ")
+
+    line := hex.EncodeToString(old[:]) + " " + hex.EncodeToString(new[:]) + " " + time.Now().Format(time.RFC3339) + " " + currentAuthor() + "\t" + reason + "\n"
+    if _, err := f.WriteString(line); err != nil {
+        panic(err)
+    }
+}
+
+
+// Returns the entries in the log of ref, newest first
+func readReflog(ref string) []ReflogEntry {
+    return readReflogEntries(reflogPath(ref))
+}
+
+
+func readTagReflog(name string) []ReflogEntry {
+    return readReflogEntries(tagReflogPath(name))
+}
+
+
+func readReflogEntries(path string) []ReflogEntry {
+    entries := make([]ReflogEntry, 0)
+
+    data, err := ioutil.ReadFile(path)
+    if err != nil {
+        return entries
+    }
+
+    for _, line := range strings.Split(string(data), "\n") {
+        if line == "" {
+            continue
+        }
+
+        tab := strings.Index(line, "\t")
+        if tab == -1 {
+            panic("invalid reflog entry '" + line + "'")
+        }
+        fields := strings.SplitN(line[:tab], " ", 4)
+        if len(fields) != 4 {
+            panic("invalid reflog entry '" + line + "'")
+        }
+
+        oldID, err := idFromHex(fields[0])
+        if err != nil {
+            panic(err)
+        }
+        newID, err := idFromHex(fields[1])
+        if err != nil {
+            panic(err)
+        }
+        timestamp, err := time.Parse(time.RFC3339, fields[2])
+        if err != nil {
+            panic(err)
+        }
+
+        entries = append([]ReflogEntry{{
+            old: oldID,
+            new: newID,
+            timestamp: timestamp,
+            identity: fields[3],
+            reason: line[tab+1:],
+        }}, entries...)
+    }
+
+    return entries
+}
+
+
+// Resolves a revision of the form <ref>@{n} to the commit ref pointed to
+// n updates ago. An empty ref is the current branch, and stash@{n} is a stash
+// entry unless there is a branch named stash.
+func resolveReflogRevision(rev string) (ID, error) {
+    at := strings.Index(rev, "@{")
+    ref := rev[:at]
+    n, err := strconv.Atoi(rev[at+2:len(rev)-1])
+    if err != nil || n < 0 {
+        return zeroID, fmt.Errorf("%w '%s'", errUnknownRevision, rev)
+    }
+
+    if ref == "" {
+        ref = getBranchFromHead().name
+        if ref == "" {
+            ref = "HEAD"
+        }
+    }
+
+    if ref == "stash" && !refExists(branchPath(ref)) {
+        ids := readStashIDs()
+        if n >= len(ids) {
+            return zeroID, fmt.Errorf("stash@{%d} does not exist", n)
+        }
+        return ids[n], nil
+    }
+
+    if ref != "HEAD" && (validateRefName(ref) != nil || !refExists(branchPath(ref))) {
+        return zeroID, fmt.Errorf("%w '%s'", errUnknownRevision, rev)
+    }
+
+    entries := readReflog(ref)
+    if n >= len(entries) {
+        return zeroID, fmt.Errorf("the log of '%s' only has %d entries", ref, len(entries))
+    }
+    return entries[n].new, nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+)
+
+
+func TestTagReflog(t *testing.T) {
+    root, cleanup := newTestRepo(t)
+    defer cleanup()
+
+    first := commitTestFile(t, root, "a.txt", "a\n")
+    second := commitTestFile(t, root, "b.txt", "b\n")
+
+    createTag("v1", first, nil, false)
+    createTag("v1", second, nil, true)
+    deleteTag("v1", "tag: deleted")
+
+    entries := readTagReflog("v1")
+    want := []struct{ old, new ID }{
+        {second, zeroID},
+        {first, second},
+        {zeroID, first},
+    }
+    if len(entries) != len(want) {
+        t.Fatalf("the log of v1 has %d entries, want %d", len(entries), len(want))
+    }
+    for i, w := range want {
+        if entries[i].old != w.old || entries[i].new != w.new {
+            t.Errorf("entry %d of the log of v1 is wrong", i)
+        }
+    }
+}
+
+
+func TestUndoReflog(t *testing.T) {
+    root, cleanup := newTestRepo(t)
+    defer cleanup()
+
+    head := commitTestFile(t, root, "a.txt", "a\n")
+
+    recordOperation("branch other")
+    createNewBranchFromHead("other")
+    recordOperation("tag v1")
+    createTag("v1", head, nil, false)
+
+    undoOperation()
+    if entries := readTagReflog("v1"); len(entries) == 0 || entries[0].new != zeroID || entries[0].reason != "undo: tag v1" {
+        t.Error("undoing the tag was not logged in its reflog")
+    }
+
+    undoOperation()
+    if entries := readReflog("other"); len(entries) == 0 || entries[0].new != zeroID || entries[0].reason != "undo: branch other" {
+        t.Error("undoing the branch was not logged in its reflog")
+    }
+}
@@ -0,0 +1,624 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+
+// When a revert, cherry-pick or rebase stops on conflicts its state is kept in
+// .lvc/sequencer until it is continued or aborted:
+//  operation ; the command in progress, ex. "revert"
+//  message   ; message of the commit being made
+//  conflicts ; conflicted files that have not been staged yet, one per line
+//  current   ; the step being picked, see todoItem
+//  todo      ; the steps left to pick, one per line
+//  orig-head ; id of HEAD before the operation started, restored on abort
+//  head-name ; branch being rebased, HEAD is detached until the rebase is done
+//  onto      ; id of the commit the branch is rebased onto
+//  edit      ; id of the commit an interactive rebase stopped at for amending
+//
+// Steps are written as "<action> <id>", the action is one of the todo list
+// commands of an interactive rebase, ex. "pick", "squash". Cherry-picks and
+// plain rebases only use "pick".
+
+
+func sequencerPath(name string) string {
+    root, _ := findLvcRoot()
+    return filepath.Join(root, ".lvc/sequencer", name)
+}
+
+
+// Returns the operation in progress, or an empty string
+func getSequencerOperation() string {
+    return readSequencerFile("operation")
+}
+
+
+func startSequencer(operation string) {
+    if err := os.MkdirAll(sequencerPath(""), 0777); err != nil {
+        panic(err)
+    }
+    writeSequencerFile("operation", operation)
+}
+
+
+func clearSequencer() {
+    if err := os.RemoveAll(sequencerPath("")); err != nil {
+        panic(err)
+    }
+}
+
+
+func readSequencerFile(name string) string {
+    data, err := ioutil.ReadFile(sequencerPath(name))
+    if err != nil {
+        return ""
+    }
+    return string(data)
+}
+
+
+func writeSequencerFile(name string, text string) {
+    if err := writeFile(sequencerPath(name), text); err != nil {
+        panic(err)
+    }
+}
+
+
+func getConflicts() []string {
+    conflicts := make([]string, 0)
+    for _, line := range strings.Split(readSequencerFile("conflicts"), "\n") {
+        if line != "" {
+            conflicts = append(conflicts, line)
+        }
+    }
+    return conflicts
+}
+
+
+func setConflicts(conflicts []string) {
+    if len(conflicts) == 0 {
+        os.Remove(sequencerPath("conflicts"))
+        return
+    }
+    writeSequencerFile("conflicts", strings.Join(conflicts, "\n") + "\n")
+}
+
+
+// Staging a conflicted file marks it as resolved
+func resolveConflict(name string) {
+    conflicts := getConflicts()
+    for i, c := range conflicts {
+        if pathsAreEqual(c, name) {
+            setConflicts(append(conflicts[:i], conflicts[i+1:]...))
+            return
+        }
+    }
+}
+
+
+func assumeNoSequencer() {
+    if operation := getSequencerOperation(); operation != "" {
+        fmt.Fprintf(os.Stderr, "error: a %s is in progress, finish it with 'lvc %s --continue' or 'lvc %s --abort'\n", operation, operation, operation)
+        os.Exit(1)
+    }
+}
+
+
+func assumeNoLocalChanges() {
+    if len(readStage()) > 0 || len(getModifiedFiles()) > 0 {
+        fmt.Fprintln(os.Stderr, "error: you have local changes, commit or reset them first")
+        os.Exit(1)
+    }
+}
+
+
+func shortID(id ID) string {
+    return hex.EncodeToString(id[:])[:12]
+}
+
+
+// Returns the files of the commit, or no files for the zeroID parent of the first commit
+func getCommitFiles(id ID) []CommitFile {
+    if id == zeroID {
+        return make([]CommitFile, 0)
+    }
+    return getCommit(id).files
+}
+
+
+// Applies the change from the commit from to the commit to onto HEAD and stages it.
+// Returns the conflicts, which are left in the working tree with conflict markers.
+func applyChangeToHead(from ID, to ID, theirsLabel string) []string {
+    head := getHead()
+    theirs := getCommitFiles(to)
+    merged, conflicts := mergeTrees(getCommitFiles(from), head.files, theirs, "HEAD", theirsLabel)
+    applyMergeResult(head.files, merged, conflicts)
+    if *flagExportBinary {
+        exportBinaryConflicts(head.files, theirs, conflicts)
+    }
+    return conflicts
+}
+
+
+func revertMessage(commit Commit) string {
+    return "Revert \"" + messageSubject(commit.message) + "\"\n\nThis reverts commit " + hex.EncodeToString(commit.id[:]) + "."
+}
+
+
+// Reverts the commit id by applying the inverse of its changes to HEAD.
+// Returns false if it stopped on conflicts.
+func revertCommit(id ID, info Commit) bool {
+    commit := getCommitWithoutFiles(id)
+    if commit.parent == zeroID {
+        fmt.Fprintln(os.Stderr, "error: cannot revert the initial commit")
+        os.Exit(1)
+    }
+
+    conflicts := applyChangeToHead(id, commit.parent, "parent of " + shortID(id))
+    if len(conflicts) > 0 {
+        startSequencer("revert")
+        writeSequencerFile("message", info.message)
+        setConflicts(conflicts)
+        return false
+    }
+
+    commitStage(info, false)
+    return true
+}
+
+
+// Puts the branch, working tree and stage back to where they were before the
+// operation started and forgets the operation
+func abortSequencer() {
+    target := getHead()
+    if origHead := readSequencerIDs("orig-head"); len(origHead) > 0 {
+        target = getCommit(origHead[0])
+    }
+
+    discardChanges(target.files)
+
+    // A rebase only moves the branch once it is done
+    operation := getSequencerOperation()
+    if headName := readSequencerFile("head-name"); headName != "" {
+        setHead(headName, operation + " (abort): returning to " + headName)
+    } else {
+        updateHead(target.id, operation + " (abort)")
+    }
+
+    clearSequencer()
+}
+
+
+// Clears the stage and puts the working tree back to files, including
+// any conflicted files
+func discardChanges(files []CommitFile) {
+    from := getStagedFiles()
+    for _, c := range getConflicts() {
+        from = append(from, CommitFile{
+            name: c,
+        })
+    }
+
+    clearStage()
+    updateWorkingTree(from, files)
+    setConflicts(nil)
+}
+
+
+func writeSequencerIDs(name string, ids []ID) {
+    builder := strings.Builder{}
+    for _, id := range ids {
+        builder.WriteString(hex.EncodeToString(id[:]) + "\n")
+    }
+    writeSequencerFile(name, builder.String())
+}
+
+
+func readSequencerIDs(name string) []ID {
+    ids := make([]ID, 0)
+    for _, line := range strings.Split(readSequencerFile(name), "\n") {
+        if line == "" {
+            continue
+        }
+        id, err := idFromHex(line)
+        if err != nil {
+            panic(err)
+        }
+        ids = append(ids, id)
+    }
+    return ids
+}
+
+
+// A step of a cherry-pick or rebase, applying the commit id according to action
+type todoItem struct {
+    action string
+    id     ID
+}
+
+
+func pickAll(ids []ID) []todoItem {
+    items := make([]todoItem, 0)
+    for _, id := range ids {
+        items = append(items, todoItem{
+            action: "pick",
+            id: id,
+        })
+    }
+    return items
+}
+
+
+func writeSequencerTodo(name string, items []todoItem) {
+    builder := strings.Builder{}
+    for _, item := range items {
+        builder.WriteString(item.action + " " + hex.EncodeToString(item.id[:]) + "\n")
+    }
+    writeSequencerFile(name, builder.String())
+}
+
+
+func readSequencerTodo(name string) []todoItem {
+    items := make([]todoItem, 0)
+    for _, line := range strings.Split(readSequencerFile(name), "\n") {
+        if line == "" {
+            continue
+        }
+        parts := strings.SplitN(line, " ", 2)
+        if len(parts) != 2 {
+            panic("invalid sequencer step '" + line + "'")
+        }
+        id, err := idFromHex(parts[1])
+        if err != nil {
+            panic(err)
+        }
+        items = append(items, todoItem{
+            action: parts[0],
+            id: id,
+        })
+    }
+    return items
+}
+
+
+// Appends a "key: value" trailer to the last paragraph of msg, or
+// a new paragraph if the last one is not made up of trailers
+func addTrailer(msg string, key string, value string) string {
+    msg = strings.TrimRight(msg, "\n")
+    trailer := key + ": " + value
+
+    paragraphs := strings.Split(msg, "\n\n")
+    last := paragraphs[len(paragraphs)-1]
+    if len(paragraphs) > 1 {
+        isTrailers := true
+        for _, line := range strings.Split(last, "\n") {
+            colon := strings.Index(line, ": ")
+            if colon <= 0 || strings.Contains(line[:colon], " ") {
+                isTrailers = false
+                break
+            }
+        }
+        if isTrailers {
+            return msg + "\n" + trailer
+        }
+    }
+
+    return msg + "\n\n" + trailer
+}
+
+
+// Commits the stage as a copy of commit, keeping its author and message.
+// Nothing is committed if the changes are already in HEAD.
+func commitReplayed(commit Commit, operation string) {
+    if len(readStage()) == 0 {
+        fmt.Println("Skipping " + shortID(commit.id) + " " + messageSubject(commit.message) + ", its changes are already in HEAD")
+        return
+    }
+
+    message := commit.message
+    if operation == "cherry-pick" {
+        message = addTrailer(message, "Cherry-picked-from", hex.EncodeToString(commit.id[:]))
+    }
+
+    info := newCommitInfo(message)
+    info.author = commit.author
+    info.timestamp = commit.timestamp
+    commitStage(info, false)
+}
+
+
+// Applies the changes of each step onto HEAD, in order. Stops at the first
+// commit that conflicts, or at an edit step, and returns false with the rest
+// saved in the sequencer.
+func replayCommits(operation string, items []todoItem, origHead ID) bool {
+    for i, item := range items {
+        if item.action == "drop" {
+            continue
+        }
+
+        commit := getCommitWithoutFiles(item.id)
+        if commit.parent == zeroID {
+            fmt.Fprintln(os.Stderr, "error: cannot " + operation + " the initial commit")
+            os.Exit(1)
+        }
+
+        conflicts := applyChangeToHead(commit.parent, item.id, shortID(item.id) + " " + messageSubject(commit.message))
+        if len(conflicts) > 0 {
+            startSequencer(operation)
+            writeSequencerTodo("current", []todoItem{item})
+            writeSequencerTodo("todo", items[i+1:])
+            writeSequencerIDs("orig-head", []ID{origHead})
+            setConflicts(conflicts)
+            return false
+        }
+
+        commitTodoItem(item, operation)
+
+        if item.action == "edit" {
+            startSequencer(operation)
+            writeSequencerTodo("todo", items[i+1:])
+            writeSequencerIDs("orig-head", []ID{origHead})
+            stopForEdit(commit)
+            return false
+        }
+    }
+
+    return true
+}
+
+
+// Commits the staged changes of a step. Squash and fixup meld them into HEAD,
+// unless HEAD is the commit the rebase started from.
+func commitTodoItem(item todoItem, operation string) {
+    commit := getCommitWithoutFiles(item.id)
+
+    switch item.action {
+    case "reword":
+        msg := messageFromEditor(commit.message + "\n" + rewordTemplate())
+        if msg != "" {
+            commit.message = msg
+        }
+        commitReplayed(commit, operation)
+    case "squash", "fixup":
+        head := getHead()
+        onto := readSequencerIDs("onto")
+        if len(onto) > 0 && onto[0] == head.id {
+            commitReplayed(commit, operation)
+            return
+        }
+
+        info := newCommitInfo(head.message)
+        info.author = head.author
+        info.timestamp = head.timestamp
+        if item.action == "squash" {
+            msg := messageFromEditor(squashTemplate(head.message, commit.message))
+            if msg != "" {
+                info.message = msg
+            }
+        }
+        commitStage(info, true)
+    default:
+        commitReplayed(commit, operation)
+    }
+}
+
+
+// Leaves the rebase stopped after committing the edit step of commit,
+// so the user can amend it before continuing
+func stopForEdit(commit Commit) {
+    os.Remove(sequencerPath("current"))
+    writeSequencerIDs("edit", []ID{getHeadID()})
+
+    fmt.Println("Stopped at " + shortID(commit.id) + " " + messageSubject(commit.message))
+    fmt.Println("Amend it with 'lvc commit --amend' and run 'lvc rebase --continue' when you are done")
+}
+
+
+func rewordTemplate() string {
+    builder := strings.Builder{}
+    builder.WriteString("# Please enter the new commit message. Lines starting with '#'\n")
+    builder.WriteString("# will be ignored, and an empty message keeps the original message.\n")
+    return builder.String()
+}
+
+
+func squashTemplate(first string, second string) string {
+    builder := strings.Builder{}
+    builder.WriteString("# This is a combination of 2 commits.\n")
+    builder.WriteString("# The first commit's message is:\n\n")
+    builder.WriteString(first + "\n\n")
+    builder.WriteString("# This is the commit message #2:\n\n")
+    builder.WriteString(second + "\n\n")
+    builder.WriteString("# Lines starting with '#' will be ignored, and an empty message\n")
+    builder.WriteString("# keeps the first message.\n")
+    return builder.String()
+}
+
+
+// Commits the resolved step and replays the rest. A rebase stopped at an edit
+// step has no current step, the user has already committed it.
+func continueReplay(operation string) bool {
+    if current := readSequencerTodo("current"); len(current) > 0 {
+        commitTodoItem(current[0], operation)
+        if current[0].action == "edit" {
+            stopForEdit(getCommitWithoutFiles(current[0].id))
+            return false
+        }
+    } else {
+        assumeNoLocalChanges()
+    }
+    os.Remove(sequencerPath("edit"))
+    return replayRemaining(operation)
+}
+
+
+// Drops the commit that stopped on conflicts and replays the rest
+func skipReplay(operation string) bool {
+    discardChanges(getHead().files)
+    os.Remove(sequencerPath("edit"))
+    return replayRemaining(operation)
+}
+
+
+func replayRemaining(operation string) bool {
+    if !replayCommits(operation, readSequencerTodo("todo"), readSequencerIDs("orig-head")[0]) {
+        return false
+    }
+
+    if operation == "rebase" {
+        finishRebase()
+    }
+    clearSequencer()
+    return true
+}
+
+
+// Replays the commits of the current branch that are not in upstream on top of
+// upstream. When interactive the user can edit the list of steps first. HEAD is
+// detached while replaying, the branch is moved once all commits are replayed.
+// Returns false if it stopped on conflicts or at an edit step.
+func rebaseOnto(upstream ID, interactive bool) (bool, error) {
+    head := getHead()
+    branch := getBranchFromHead()
+    // The rebased commits are put on the branch when the rebase finishes
+    if branch.name == "" {
+        return false, errors.New("cannot rebase a detached HEAD, check out a branch first")
+    }
+
+    base, _ := findMergeBase(head.id, upstream)
+    if base == upstream && !interactive {
+        fmt.Println("Current branch " + branch.name + " is up to date")
+        return true, nil
+    }
+    items := pickAll(commitsBetween(base, head.id))
+
+    if interactive {
+        items = editTodoList(items, upstream)
+        if len(items) == 0 {
+            fmt.Println("Nothing to do")
+            return true, nil
+        }
+    }
+
+    startSequencer("rebase")
+    writeSequencerFile("head-name", branch.name)
+    writeSequencerIDs("orig-head", []ID{head.id})
+    writeSequencerIDs("onto", []ID{upstream})
+
+    clearStage()
+    updateWorkingTree(head.files, getCommitFiles(upstream))
+    detachHead(upstream, "rebase: checkout " + hex.EncodeToString(upstream[:]))
+
+    if !replayCommits("rebase", items, head.id) {
+        return false, nil
+    }
+
+    finishRebase()
+    clearSequencer()
+    return true, nil
+}
+
+
+var todoActions = map[string]string{
+    "p": "pick",
+    "r": "reword",
+    "e": "edit",
+    "s": "squash",
+    "f": "fixup",
+    "d": "drop",
+}
+
+
+// Opens the editor with the steps of an interactive rebase and returns the
+// steps the user kept, in the order they were left in
+func editTodoList(items []todoItem, onto ID) []todoItem {
+    builder := strings.Builder{}
+    for _, item := range items {
+        builder.WriteString(item.action + " " + shortID(item.id) + " " + messageSubject(getCommitWithoutFiles(item.id).message) + "\n")
+    }
+    builder.WriteString("\n")
+    builder.WriteString("# Rebase onto " + shortID(onto) + "\n")
+    builder.WriteString("#\n")
+    builder.WriteString("# Commands:\n")
+    builder.WriteString("#  p, pick <commit>   = use commit\n")
+    builder.WriteString("#  r, reword <commit> = use commit, but edit the commit message\n")
+    builder.WriteString("#  e, edit <commit>   = use commit, but stop for amending\n")
+    builder.WriteString("#  s, squash <commit> = use commit, but meld into previous commit\n")
+    builder.WriteString("#  f, fixup <commit>  = like squash, but discard this commit's message\n")
+    builder.WriteString("#  d, drop <commit>   = remove commit\n")
+    builder.WriteString("#\n")
+    builder.WriteString("# The lines are executed from top to bottom and can be reordered.\n")
+    builder.WriteString("# Removing a line drops the commit, removing every line aborts the rebase.\n")
+
+    root, _ := findLvcRoot()
+    text, err := editText(filepath.Join(root, ".lvc/rebase-todo"), builder.String())
+    if err != nil {
+        fmt.Fprintln(os.Stderr, "error: failed to run editor '" + getEditor() + "'")
+        fmt.Fprintln(os.Stderr, err)
+        os.Exit(1)
+    }
+
+    result := make([]todoItem, 0)
+    for _, line := range strings.Split(text, "\n") {
+        line = strings.TrimSpace(line)
+        if line == "" || strings.HasPrefix(line, "#") {
+            continue
+        }
+
+        fields := strings.Fields(line)
+        action := fields[0]
+        if long, ok := todoActions[action]; ok {
+            action = long
+        }
+        valid := false
+        for _, a := range todoActions {
+            if a == action {
+                valid = true
+            }
+        }
+        if !valid || len(fields) < 2 {
+            fmt.Fprintln(os.Stderr, "error: invalid line in the todo list '" + line + "'")
+            os.Exit(1)
+        }
+
+        id, err := resolveRevision(fields[1])
+        if err != nil {
+            fmt.Fprintln(os.Stderr, "error: " + err.Error())
+            os.Exit(1)
+        }
+
+        if (action == "squash" || action == "fixup") && len(result) == 0 {
+            fmt.Fprintln(os.Stderr, "error: cannot '" + action + "' without a previous commit")
+            os.Exit(1)
+        }
+
+        result = append(result, todoItem{
+            action: action,
+            id: id,
+        })
+    }
+
+    return result
+}
+
+
+// Moves the rebased branch to HEAD and checks it out again
+func finishRebase() {
+    branch := readSequencerFile("head-name")
+    id := getHeadID()
+    old := getBranchID(branch)
+
+    onto := readSequencerIDs("onto")[0]
+    updateBranch(branch, id, "rebase finished: " + branch + " onto " + hex.EncodeToString(onto[:]))
+    setHead(branch, "rebase finished: returning to " + branch)
+
+    fmt.Println("Rebased " + branch + " to " + hex.EncodeToString(id[:]))
+    fmt.Println("The original tip " + hex.EncodeToString(old[:]) + " is kept in the reflog")
+}
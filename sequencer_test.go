@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+)
+
+
+func TestRebaseDetachedHead(t *testing.T) {
+    root, cleanup := newTestRepo(t)
+    defer cleanup()
+
+    base := commitTestFile(t, root, "a.txt", "a\n")
+    commitTestFile(t, root, "b.txt", "b\n")
+    detachHead(getHeadID(), "test")
+    head := getHeadID()
+
+    if _, err := rebaseOnto(base, false); err == nil {
+        t.Fatal("rebaseOnto accepted a detached HEAD")
+    }
+    if op := getSequencerOperation(); op != "" {
+        t.Errorf("the rebase left a %q in progress", op)
+    }
+    if !isHeadDetached() || getHeadID() != head {
+        t.Error("the rebase moved HEAD")
+    }
+}
+
+
+func TestRebaseBranch(t *testing.T) {
+    root, cleanup := newTestRepo(t)
+    defer cleanup()
+
+    commitTestFile(t, root, "a.txt", "a\n")
+    createNewBranchFromHead("other")
+    commitTestFile(t, root, "b.txt", "b\n")
+    checkoutBranch("other")
+    upstream := commitTestFile(t, root, "c.txt", "c\n")
+    checkoutBranch("master")
+
+    ok, err := rebaseOnto(upstream, false)
+    if err != nil || !ok {
+        t.Fatalf("rebaseOnto failed: %v", err)
+    }
+    if isHeadDetached() || getBranchFromHead().name != "master" {
+        t.Fatal("the rebase did not return to master")
+    }
+    head := getCommitWithoutFiles(getHeadID())
+    if head.parent != upstream {
+        t.Error("the rebased commit is not on top of upstream")
+    }
+}
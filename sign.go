@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+
+// Commits and annotated tags are signed by adding a header line to the object:
+//  signature <publickey> <signature> ; both base64 encoded
+//
+// The signed payload is the object without the signature line. For commits
+// the line is placed after the timestamp, for tag objects after the other headers.
+//
+// Keys are created with 'lvc keygen <path>' and enabled with the user.signingkey
+// option. The private key file holds the base64 encoded ed25519 seed, and the
+// public key is written next to it with a ".pub" extension.
+//
+// Signatures are verified against .lvc/trusted_keys, one key per line:
+//  <publickey> <name> ; name is usually the author, ex. "thebirk <pingnor@gmail.com>"
+//
+// The author and committer are free text, so a signature is only good if the
+// name of the key matches the committer of the commit or the tagger of the tag.
+// Names match if they are equal or have the same email address.
+
+
+type signatureStatus int
+
+const (
+    sigNone signatureStatus = iota
+    sigGood
+    sigUntrusted
+    sigMismatch
+    sigBad
+)
+
+
+// Creates a key pair at path, identity is written to the public key file
+// and should match the committer of the commits signed with it
+func generateSigningKey(path string, identity string) (ed25519.PublicKey, error) {
+    public, private, err := ed25519.GenerateKey(rand.Reader)
+    if err != nil {
+        return nil, err
+    }
+
+    if _, err := os.Stat(path); err == nil {
+        return nil, errors.New("'" + path + "' already exists")
+    }
+
+    if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+        return nil, err
+    }
+
+    seed := base64.StdEncoding.EncodeToString(private.Seed())
+    if err := ioutil.WriteFile(path, []byte(seed + "\n"), 0600); err != nil {
+        return nil, err
+    }
+
+    pub := base64.StdEncoding.EncodeToString(public)
+    if err := ioutil.WriteFile(path + ".pub", []byte(pub + " " + identity + "\n"), 0644); err != nil {
+        return nil, err
+    }
+
+    return public, nil
+}
+
+
+// Returns the key configured with user.signingkey, or nil if signing is disabled
+func loadSigningKey() ed25519.PrivateKey {
+    path := getConfig("user.signingkey")
+    if path == "" {
+        return nil
+    }
+
+    data, err := ioutil.ReadFile(expandHome(path))
+    if err != nil {
+        fmt.Fprintln(os.Stderr, "error: failed to read signing key '" + path + "'")
+        fmt.Fprintln(os.Stderr, err)
+        os.Exit(1)
+    }
+
+    seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+    if err != nil || len(seed) != ed25519.SeedSize {
+        fmt.Fprintln(os.Stderr, "error: '" + path + "' is not a valid signing key")
+        os.Exit(1)
+    }
+
+    return ed25519.NewKeyFromSeed(seed)
+}
+
+
+// Signs payload with the configured key, returns the value for the signature
+// line or an empty string if signing is disabled
+func signPayload(payload string) string {
+    key := loadSigningKey()
+    if key == nil {
+        return ""
+    }
+
+    public := key.Public().(ed25519.PublicKey)
+    signature := ed25519.Sign(key, []byte(payload))
+
+    return base64.StdEncoding.EncodeToString(public) + " " + base64.StdEncoding.EncodeToString(signature)
+}
+
+
+// Returns true for the "<blobid> <name>" lines at the end of a commit
+func isCommitFileLine(line string) bool {
+    if len(line) < 65 || line[64] != ' ' {
+        return false
+    }
+    _, err := hex.DecodeString(line[:64])
+    return err == nil
+}
+
+
+// Splits an object into the signed payload and the signature line value.
+// Header lines are searched from the skip'th line until the first empty
+// line or commit file line.
+func splitSignature(data string, skip int) (string, string) {
+    lines := strings.SplitAfter(data, "\n")
+
+    for i := skip; i < len(lines); i++ {
+        line := strings.TrimSuffix(lines[i], "\n")
+        if line == "" || isCommitFileLine(line) {
+            break
+        }
+
+        if strings.HasPrefix(line, "signature ") {
+            payload := strings.Join(lines[:i], "") + strings.Join(lines[i+1:], "")
+            return payload, strings.TrimPrefix(line, "signature ")
+        }
+    }
+
+    return data, ""
+}
+
+
+// Returns the name of every trusted key, keyed by the base64 encoded public key
+func readTrustedKeys() map[string]string {
+    keys := make(map[string]string)
+
+    root, _ := findLvcRoot()
+    f, err := os.Open(filepath.Join(root, ".lvc/trusted_keys"))
+    if err != nil {
+        return keys
+    }
+    defer f.Close()
+
+    scanner := bufio.NewScanner(f)
+    for scanner.Scan() {
+        line := strings.TrimSpace(scanner.Text())
+        if line == "" || strings.HasPrefix(line, "#") {
+            continue
+        }
+
+        kv := strings.SplitN(line, " ", 2)
+        name := ""
+        if len(kv) == 2 {
+            name = strings.TrimSpace(kv[1])
+        }
+        keys[kv[0]] = name
+    }
+
+    return keys
+}
+
+
+// Returns the email address of an identity like "name <email>", or an empty string
+func identityEmail(identity string) string {
+    start := strings.LastIndex(identity, "<")
+    end := strings.LastIndex(identity, ">")
+    if start == -1 || end < start {
+        return ""
+    }
+    return strings.ToLower(strings.TrimSpace(identity[start+1:end]))
+}
+
+
+func identitiesMatch(a string, b string) bool {
+    if strings.TrimSpace(a) == strings.TrimSpace(b) {
+        return true
+    }
+    email := identityEmail(a)
+    return email != "" && email == identityEmail(b)
+}
+
+
+// Verifies the signature embedded in data, returns the status and the signer,
+// which is the trusted name or the public key if untrusted. claimed is the
+// committer or tagger the object says it is from.
+func verifySignature(data string, skip int, claimed string) (signatureStatus, string) {
+    payload, sig := splitSignature(data, skip)
+    if sig == "" {
+        return sigNone, ""
+    }
+
+    parts := strings.SplitN(sig, " ", 2)
+    if len(parts) != 2 {
+        return sigBad, ""
+    }
+
+    public, err := base64.StdEncoding.DecodeString(parts[0])
+    if err != nil || len(public) != ed25519.PublicKeySize {
+        return sigBad, parts[0]
+    }
+    signature, err := base64.StdEncoding.DecodeString(parts[1])
+    if err != nil {
+        return sigBad, parts[0]
+    }
+
+    if !ed25519.Verify(ed25519.PublicKey(public), []byte(payload), signature) {
+        return sigBad, parts[0]
+    }
+
+    name, trusted := readTrustedKeys()[parts[0]]
+    if !trusted {
+        return sigUntrusted, parts[0]
+    }
+    // A key without a name cannot vouch for anyone
+    if name == "" {
+        return sigMismatch, parts[0]
+    }
+    if !identitiesMatch(name, claimed) {
+        return sigMismatch, name
+    }
+    return sigGood, name
+}
+
+
+func verifyCommit(id ID) (signatureStatus, string) {
+    root, _ := findLvcRoot()
+    data, err := ioutil.ReadFile(filepath.Join(root, ".lvc/commits/", hex.EncodeToString(id[:])))
+    if err != nil {
+        panic(err)
+    }
+    // skip parent, message, author and timestamp
+    return verifySignature(string(data), 4, getCommitWithoutFiles(id).committer)
+}
+
+
+func verifyTagObject(id ID) (signatureStatus, string) {
+    root, _ := findLvcRoot()
+    data, err := ioutil.ReadFile(filepath.Join(root, ".lvc/tagobjects/", hex.EncodeToString(id[:])))
+    if err != nil {
+        panic(err)
+    }
+    return verifySignature(string(data), 0, getTagObject(id).tagger)
+}
+
+
+func describeSignature(status signatureStatus, signer string) string {
+    switch status {
+    case sigGood:
+        return "good signature from " + signer
+    case sigUntrusted:
+        return "valid signature from untrusted key " + signer
+    case sigMismatch:
+        return "MISMATCHED signature, made by " + signer + " who is not the committer or tagger"
+    case sigBad:
+        return "BAD signature"
+    }
+    return "not signed"
+}
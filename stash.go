@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+
+// A stash entry is made of two commits:
+//  index   ; the staged files, its parent is HEAD at the time of stashing
+//  working ; the tracked files as they were in the working tree, its parent is the index commit
+//
+// .lvc/stash holds the id of the working commit of every entry, newest first.
+// Entries are referred to by their position, ex. "stash@{0}" or just "0".
+// Untracked files are not stashed.
+
+
+func stashPath() string {
+    root, _ := findLvcRoot()
+    return filepath.Join(root, ".lvc/stash")
+}
+
+
+func readStashIDs() []ID {
+    ids := make([]ID, 0)
+
+    data, err := ioutil.ReadFile(stashPath())
+    if err != nil {
+        return ids
+    }
+
+    for _, line := range strings.Split(string(data), "\n") {
+        if line == "" {
+            continue
+        }
+        id, err := idFromHex(line)
+        if err != nil {
+            panic(err)
+        }
+        ids = append(ids, id)
+    }
+    return ids
+}
+
+
+func writeStashIDs(ids []ID) {
+    builder := strings.Builder{}
+    for _, id := range ids {
+        builder.WriteString(hex.EncodeToString(id[:]) + "\n")
+    }
+    if err := writeFile(stashPath(), builder.String()); err != nil {
+        panic(err)
+    }
+}
+
+
+// Returns true if id is one of the commits of a stash entry
+func isStashCommit(id ID) bool {
+    for _, w := range readStashIDs() {
+        if w == id || getCommitWithoutFiles(w).parent == id {
+            return true
+        }
+    }
+    return false
+}
+
+
+// Returns the position of the entry referred to by ref, "stash@{n}" or "n"
+func parseStashRef(ref string) (int, error) {
+    n := strings.TrimSuffix(strings.TrimPrefix(ref, "stash@{"), "}")
+    index, err := strconv.Atoi(n)
+    if err != nil || index < 0 {
+        return 0, fmt.Errorf("'%s' is not a stash entry", ref)
+    }
+    if index >= len(readStashIDs()) {
+        return 0, fmt.Errorf("stash@{%d} does not exist", index)
+    }
+    return index, nil
+}
+
+
+// Saves the stage and the working tree in a new stash entry and resets both
+// to HEAD. Returns false if there was nothing to save.
+func stashPush(msg string) bool {
+    root, _ := findLvcRoot()
+    head := getHead()
+    staged := getStagedFiles()
+    working := getWorkingFiles()
+
+    if len(stageEntriesBetween(head.files, working)) == 0 && len(readStage()) == 0 {
+        return false
+    }
+
+    branch := getBranchFromHead().name
+    if branch == "" {
+        branch = "(no branch)"
+    }
+    headDescription := shortID(head.id) + " " + messageSubject(head.message)
+    if msg == "" {
+        msg = "WIP on " + branch + ": " + headDescription
+    } else {
+        msg = "On " + branch + ": " + msg
+    }
+
+    index := newCommitInfo("index on " + branch + ": " + headDescription)
+    index.parent = head.id
+    index.files = staged
+    indexID := writeCommit(index)
+
+    for _, f := range working {
+        createBlobForFileWithID(filepath.Join(root, f.name), f.id)
+    }
+
+    work := newCommitInfo(msg)
+    work.parent = indexID
+    work.files = working
+    workID := writeCommit(work)
+
+    writeStashIDs(append([]ID{workID}, readStashIDs()...))
+
+    clearStage()
+    updateWorkingTree(working, head.files)
+
+    fmt.Println("Saved working directory and stage: " + msg)
+    return true
+}
+
+
+// Three-way merges the changes of the stash entry onto HEAD. The stage is
+// restored as well if its changes merge cleanly. Returns false on conflicts,
+// which are left in the working tree with conflict markers.
+func stashApply(index int) bool {
+    work := getCommit(readStashIDs()[index])
+    staged := getCommit(work.parent)
+    base := getCommitFiles(staged.parent)
+    head := getHead()
+
+    merged, conflicts := mergeTrees(base, head.files, work.files, "Updated upstream", "Stashed changes")
+    updateWorkingTree(head.files, merged)
+
+    if len(conflicts) > 0 {
+        clearStage()
+        if *flagExportBinary {
+            exportBinaryConflicts(head.files, work.files, conflicts)
+        }
+        fmt.Println("Conflicts in:")
+        for _, c := range conflicts {
+            fmt.Println("    " + describeConflict(c))
+        }
+        fmt.Println("Resolve the conflicts and stage them with 'lvc add', the stash entry is kept")
+        return false
+    }
+
+    mergedStage, stageConflicts := mergeTrees(base, head.files, staged.files, "Updated upstream", "Stashed changes")
+    if len(stageConflicts) > 0 {
+        clearStage()
+        fmt.Println("The stage could not be restored, the changes are left unstaged")
+    } else {
+        writeStage(stageEntriesBetween(head.files, mergedStage))
+    }
+
+    return true
+}
+
+
+func stashDrop(index int) {
+    ids := readStashIDs()
+    id := ids[index]
+    writeStashIDs(append(ids[:index], ids[index+1:]...))
+
+    fmt.Printf("Dropped stash@{%d} (%s)\n", index, hex.EncodeToString(id[:]))
+}
+
+
+func stashList() {
+    for i, id := range readStashIDs() {
+        fmt.Printf("stash@{%d}: %s\n", i, messageSubject(getCommitWithoutFiles(id).message))
+    }
+}
+
+
+// Prints the files changed by the stash entry, relative to the commit it was made on
+func stashShow(index int) {
+    work := getCommit(readStashIDs()[index])
+    base := getCommitFiles(getCommitWithoutFiles(work.parent).parent)
+
+    for _, e := range stageEntriesBetween(base, work.files) {
+        status := "M"
+        if e.id == zeroID {
+            status = "D"
+        } else if _, ok := findCommitFile(base, e.name); !ok {
+            status = "A"
+        }
+        fmt.Println(status + "    " + e.name)
+    }
+}
+
+
+func assumeStashEntry(ref string) int {
+    index, err := parseStashRef(ref)
+    if err != nil {
+        fmt.Fprintln(os.Stderr, "error: " + err.Error())
+        os.Exit(1)
+    }
+    return index
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -9,7 +10,9 @@ import (
 	"os/exec"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
+	"time"
 	"unicode/utf8"
 )
 
@@ -60,6 +63,76 @@ func walkUp(root string, walkFn walkFunc) error {
 }
 
 
+// Returns the users editor, a variable with only whitespace counts as unset
+func getEditor() string {
+    if editor := os.Getenv("VISUAL"); strings.TrimSpace(editor) != "" {
+        return editor
+    }
+    if editor := os.Getenv("EDITOR"); strings.TrimSpace(editor) != "" {
+        return editor
+    }
+    if runtime.GOOS == "windows" {
+        return "notepad"
+    }
+    return "vi"
+}
+
+
+// Opens path in the users editor and waits for it to exit
+func runEditor(path string) error {
+    // The editor may come with arguments, ex. "code --wait"
+    args := strings.Fields(getEditor())
+    if len(args) == 0 {
+        return errors.New("no editor is set, set $VISUAL or $EDITOR")
+    }
+    editor := exec.Command(args[0], append(args[1:], path)...)
+    editor.Stdin = os.Stdin
+    editor.Stdout = os.Stdout
+    editor.Stderr = os.Stderr
+    return editor.Run()
+}
+
+
+// Lets the user edit text in their editor, using path as the temporary file
+func editText(path string, text string) (string, error) {
+    if err := writeFile(path, text); err != nil {
+        return "", err
+    }
+    defer os.Remove(path)
+
+    if err := runEditor(path); err != nil {
+        return "", err
+    }
+
+    data, err := ioutil.ReadFile(path)
+    if err != nil {
+        return "", err
+    }
+    return string(data), nil
+}
+
+
+// Colors are only used when writing to a terminal, so output
+// redirected to a file can be read by other tools
+func stdoutIsTerminal() bool {
+    info, err := os.Stdout.Stat()
+    return err == nil && info.Mode() & os.ModeCharDevice != 0
+}
+
+
+// Returns the width of the terminal, falling back to $COLUMNS and then 80
+// when stdout is not a terminal
+func terminalWidth() int {
+    if columns := stdoutTerminalWidth(); columns > 0 {
+        return columns
+    }
+    if columns, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && columns > 0 {
+        return columns
+    }
+    return 80
+}
+
+
 func startPager() (*exec.Cmd, io.WriteCloser) {
     var less *exec.Cmd
     if runtime.GOOS == "windows" {
@@ -180,6 +253,57 @@ func printTextWithPrefixSuffix(writer io.Writer, text string, prefix string, suf
 
 
 
+// Parses a date given by the user, the utc offset is kept as is
+func parseDate(text string) (time.Time, error) {
+    layouts := []string{
+        time.RFC3339,
+        "2006-01-02 15:04:05 -0700",
+        "2006-01-02T15:04:05-0700",
+        "2006-01-02 15:04:05",
+        "2006-01-02",
+    }
+
+    for _, layout := range layouts {
+        // Dates without an offset are in local time
+        if t, err := time.ParseInLocation(layout, text, time.Local); err == nil {
+            return t, nil
+        }
+    }
+
+    return time.Time{}, errors.New("invalid date '" + text + "', expected a date like '2006-01-02 15:04:05 -0700'")
+}
+
+
+// Formats a date in its own utc offset, not the local one
+func formatDate(t time.Time) string {
+    return t.Format("2006-01-02 15:04:05 -0700")
+}
+
+
+// Removes the file at path along with any directories left empty
+// by its removal, stopping at base
+func removeFileAndEmptyDirs(base string, path string) error {
+    if err := os.Remove(path); err != nil {
+        return err
+    }
+
+    for dir := filepath.Dir(path); dir != base && pathIsInside(base, dir); dir = filepath.Dir(dir) {
+        // Remove fails on directories that are not empty
+        if os.Remove(dir) != nil {
+            break
+        }
+    }
+
+    return nil
+}
+
+
+func pathIsInside(base string, path string) bool {
+    rel, err := filepath.Rel(base, path)
+    return err == nil && rel != "." && !strings.HasPrefix(rel, "..")
+}
+
+
 func writeFile(path string, text string) error {
     return ioutil.WriteFile(path, []byte(text), 0644)
 }
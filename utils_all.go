@@ -2,7 +2,28 @@
 
 package main
 
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
 func hideFile(filename string) error {
     // Do nothing
     return nil
-}
\ No newline at end of file
+}
+
+// Returns the width of the terminal stdout is connected to, or 0 if it is not a terminal
+func stdoutTerminalWidth() int {
+    var size struct {
+        rows    uint16
+        columns uint16
+        xpixel  uint16
+        ypixel  uint16
+    }
+    _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, os.Stdout.Fd(), uintptr(syscall.TIOCGWINSZ), uintptr(unsafe.Pointer(&size)))
+    if errno != 0 {
+        return 0
+    }
+    return int(size.columns)
+}
@@ -1,6 +1,9 @@
 package main
 
-import "syscall"
+import (
+	"syscall"
+	"unsafe"
+)
 
 func hideFile(filename string) error {
     filenameW, err := syscall.UTF16PtrFromString(filename)
@@ -13,3 +16,33 @@ func hideFile(filename string) error {
     }
     return nil
 }
+
+var procGetConsoleScreenBufferInfo = syscall.NewLazyDLL("kernel32.dll").NewProc("GetConsoleScreenBufferInfo")
+
+type consoleCoord struct {
+    x int16
+    y int16
+}
+
+type consoleScreenBufferInfo struct {
+    size              consoleCoord
+    cursorPosition    consoleCoord
+    attributes        uint16
+    window            struct {
+        left   int16
+        top    int16
+        right  int16
+        bottom int16
+    }
+    maximumWindowSize consoleCoord
+}
+
+// Returns the width of the console stdout is connected to, or 0 if it is not a console
+func stdoutTerminalWidth() int {
+    var info consoleScreenBufferInfo
+    ok, _, _ := procGetConsoleScreenBufferInfo.Call(uintptr(syscall.Stdout), uintptr(unsafe.Pointer(&info)))
+    if ok == 0 {
+        return 0
+    }
+    return int(info.window.right - info.window.left) + 1
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"unicode"
+
+	"github.com/sergi/go-diff/diffmatchpatch"
+)
+
+
+// --word-diff shows the changed lines of a hunk as a single block where
+// removed and added words are marked within the lines:
+//  plain: [-removed-]{+added+}
+//  color: removed words in red and added words in green, without markers
+// Context lines are written as they are, without the ' ' prefix.
+
+// The value of --word-diff, empty when word diff is off
+type wordDiffMode string
+
+const (
+    wordDiffPlain = "plain"
+    wordDiffColor = "color"
+)
+
+func (m *wordDiffMode) String() string {
+    if m == nil {
+        return ""
+    }
+    return string(*m)
+}
+
+func (m *wordDiffMode) Set(value string) error {
+    switch value {
+    // --word-diff without a value
+    case "true", wordDiffPlain:
+        *m = wordDiffPlain
+    case wordDiffColor:
+        *m = wordDiffColor
+    case "false", "none":
+        *m = ""
+    default:
+        return errors.New("expected color, plain or none")
+    }
+    return nil
+}
+
+// Lets the flag be given without a value, like a bool flag
+func (m *wordDiffMode) IsBoolFlag() bool {
+    return true
+}
+
+
+func wordDiffFlag(name string, usage string) *wordDiffMode {
+    mode := new(wordDiffMode)
+    flag.Var(mode, name, usage)
+    return mode
+}
+
+
+// Splits text into words, runs of whitespace other than newlines, newlines
+// and single punctuation characters, so that "f(a, b)" is "f", "(", "a", ",", " ", "b", ")"
+func splitWords(text string) []string {
+    words := make([]string, 0)
+    start := 0
+    runes := []rune(text)
+
+    class := func(r rune) int {
+        switch {
+        case r == '\n':
+            return 0
+        case unicode.IsSpace(r):
+            return 1
+        case unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_':
+            return 2
+        }
+        return 3
+    }
+
+    for i := 1; i <= len(runes); i++ {
+        if i < len(runes) && class(runes[i]) == class(runes[start]) && class(runes[start]) != 0 && class(runes[start]) != 3 {
+            continue
+        }
+        words = append(words, string(runes[start:i]))
+        start = i
+    }
+    return words
+}
+
+
+// Diffs the words of old and new text. Like DiffLinesToChars does for lines,
+// every distinct word is mapped to a single rune before diffing.
+func diffWords(oldText string, newText string) []diffmatchpatch.Diff {
+    index := make(map[string]rune)
+    words := make([]string, 0)
+    encode := func(text string) string {
+        encoded := strings.Builder{}
+        for _, word := range splitWords(text) {
+            r, ok := index[word]
+            if !ok {
+                r = rune(len(words) + 1)
+                // Skip the surrogate range, they are not valid runes in a string
+                if r >= 0xD800 {
+                    r += 0x800
+                }
+                index[word] = r
+                words = append(words, word)
+            }
+            encoded.WriteRune(r)
+        }
+        return encoded.String()
+    }
+
+    a := encode(oldText)
+    b := encode(newText)
+
+    decode := make(map[rune]string, len(index))
+    for word, r := range index {
+        decode[r] = word
+    }
+
+    dmp := diffmatchpatch.New()
+    // Joins small equalities between changes into the changes, so the output
+    // reads as whole phrases instead of scattered words. This is done before
+    // decoding so changes are only ever split at word boundaries.
+    diffs := dmp.DiffCleanupSemantic(dmp.DiffMain(a, b, false))
+    for i := range diffs {
+        text := strings.Builder{}
+        for _, r := range diffs[i].Text {
+            text.WriteString(decode[r])
+        }
+        diffs[i].Text = text.String()
+    }
+
+    return diffs
+}
+
+
+// Writes the lines of a hunk with the changed words marked
+func writeWordDiff(w io.Writer, oldLines []string, newLines []string, mode wordDiffMode) {
+    text := strings.Builder{}
+    for _, d := range diffWords(strings.Join(oldLines, ""), strings.Join(newLines, "")) {
+        start, end, lineColor := "", "", ""
+        switch d.Type {
+        case diffmatchpatch.DiffDelete:
+            start, end, lineColor = "[-", "-]", colorRed
+        case diffmatchpatch.DiffInsert:
+            start, end, lineColor = "{+", "+}", colorGreen
+        }
+        if mode == wordDiffColor {
+            start, end = lineColor, colorReset
+        }
+        if lineColor == "" {
+            start, end = "", ""
+        }
+
+        // Markers are closed at the end of a line and opened again on the next
+        for i, part := range strings.Split(d.Text, "\n") {
+            if i > 0 {
+                text.WriteString("\n")
+            }
+            if part != "" {
+                text.WriteString(start + part + end)
+            }
+        }
+    }
+
+    result := text.String()
+    if result != "" && !strings.HasSuffix(result, "\n") {
+        result += "\n"
+    }
+    fmt.Fprint(w, result)
+}